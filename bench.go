@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/barnacs/compy/proxy"
+)
+
+// axis is one dimension of the settings matrix: a flag name and the values
+// to try. The pseudo flag "webp" toggles image/webp in the Accept header.
+type axis struct {
+	name   string
+	values []string
+}
+
+type matrixFlag []axis
+
+func (m *matrixFlag) String() string {
+	var s []string
+	for _, a := range *m {
+		s = append(s, a.name+"="+strings.Join(a.values, ","))
+	}
+	return strings.Join(s, " ")
+}
+
+func (m *matrixFlag) Set(v string) error {
+	kv := strings.SplitN(v, "=", 2)
+	if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+		return fmt.Errorf("expected <flag>=<value>[,<value>...]")
+	}
+	if kv[0] != "webp" && flag.Lookup(kv[0]) == nil {
+		return fmt.Errorf("unknown flag %q", kv[0])
+	}
+	*m = append(*m, axis{name: kv[0], values: strings.Split(kv[1], ",")})
+	return nil
+}
+
+// settings is a single point of the matrix.
+type settings []string
+
+func (m matrixFlag) combinations() []settings {
+	combinations := []settings{nil}
+	for _, a := range m {
+		var next []settings
+		for _, c := range combinations {
+			for _, v := range a.values {
+				s := append(settings{}, c...)
+				next = append(next, append(s, a.name+"="+v))
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
+
+func (s settings) String() string {
+	if len(s) == 0 {
+		return "defaults"
+	}
+	return strings.Join(s, " ")
+}
+
+type savings struct {
+	count   int
+	read    uint64
+	written uint64
+	elapsed time.Duration
+}
+
+func (s *savings) add(read, written uint64, elapsed time.Duration) {
+	s.count++
+	s.read += read
+	s.written += written
+	s.elapsed += elapsed
+}
+
+// benchCommand replays the responses recorded in a HAR file through the
+// transcoders for every combination of the settings matrix.
+func benchCommand(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var matrix matrixFlag
+	fs.Var(&matrix, "m", "settings to compare as <flag>=<value>[,<value>...], may be repeated")
+	accept := fs.String("accept", "", "Accept header to use instead of the recorded one")
+	acceptEncoding := fs.String("accept-encoding", "", "Accept-Encoding header to use instead of the recorded one")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), `Usage: compy [flags] bench [options] <file.har>...
+
+Example: compy bench -m jpeg=30,50,70 -m brotli=4,11 -m webp=on,off capture.har
+
+Options:
+`)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	var entries []proxy.HAREntry
+	for _, path := range fs.Args() {
+		har, err := proxy.ReadHAR(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		entries = append(entries, har.Log.Entries...)
+	}
+
+	summary := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(summary, "settings\tresponses\tin\tout\tsize\ttime\t")
+	for _, s := range matrix.combinations() {
+		total, byType, err := benchSettings(s, entries, *accept, *acceptEncoding)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", s, err)
+			return 1
+		}
+
+		fmt.Printf("%s:\n", s)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "type\tresponses\tin\tout\tsize\ttime\t")
+		var types []string
+		for ct := range byType {
+			types = append(types, ct)
+		}
+		sort.Strings(types)
+		for _, ct := range types {
+			printSavings(tw, ct, byType[ct])
+		}
+		printSavings(tw, "total", total)
+		tw.Flush()
+		fmt.Println()
+
+		printSavings(summary, s.String(), total)
+	}
+	summary.Flush()
+	return 0
+}
+
+func printSavings(w *tabwriter.Writer, name string, s *savings) {
+	fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%3.1f%%\t%s\t\n", name, s.count, s.read, s.written,
+		percent(s.written, s.read), s.elapsed.Round(time.Millisecond))
+}
+
+// benchSettings replays entries with the flags set as in s, restoring them
+// afterwards.
+func benchSettings(s settings, entries []proxy.HAREntry, accept, acceptEncoding string) (*savings, map[string]*savings, error) {
+	webp := ""
+	defaults := make(map[string]string)
+	defer func() {
+		for name, value := range defaults {
+			flag.Set(name, value)
+		}
+	}()
+	for _, kv := range s {
+		nv := strings.SplitN(kv, "=", 2)
+		if nv[0] == "webp" {
+			webp = nv[1]
+			continue
+		}
+		f := flag.Lookup(nv[0])
+		if f == nil {
+			return nil, nil, fmt.Errorf("unknown flag %q", nv[0])
+		}
+		if _, ok := defaults[nv[0]]; !ok {
+			defaults[nv[0]] = f.Value.String()
+		}
+		if err := flag.Set(nv[0], nv[1]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	p := proxy.New(*host, *cert)
+	addTranscoders(p)
+
+	total := &savings{}
+	byType := make(map[string]*savings)
+	for i := range entries {
+		if entries[i].Error != "" || entries[i].Coalesced {
+			// the request failed, there is no response, or it shared the
+			// response of another entry
+			continue
+		}
+		resp, headers, err := replayedResponse(&entries[i])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skipping %s: %s\n", entries[i].Request.URL, err)
+			continue
+		}
+		if accept != "" {
+			headers.Set("Accept", accept)
+		}
+		if acceptEncoding != "" {
+			headers.Set("Accept-Encoding", acceptEncoding)
+		}
+		switch webp {
+		case "on":
+			headers.Set("Accept", withWebP(headers.Get("Accept")))
+		case "off":
+			headers.Set("Accept", withoutWebP(headers.Get("Accept")))
+		}
+
+		start := time.Now()
+		read, written, err := p.TranscodeResponse(proxy.NewResponseBuffer(), resp, headers)
+		elapsed := time.Since(start)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", entries[i].Request.URL, err)
+			continue
+		}
+		ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if byType[ct] == nil {
+			byType[ct] = &savings{}
+		}
+		byType[ct].add(read, written, elapsed)
+		total.add(read, written, elapsed)
+	}
+	return total, byType, nil
+}
+
+// replayedResponse reconstructs the upstream response of a HAR entry.
+// Captures made by compy keep the original body, other HAR files only have
+// the decoded body the browser received.
+func replayedResponse(e *proxy.HAREntry) (*http.Response, http.Header, error) {
+	content := e.Response.Original
+	header := proxy.HARHeader(e.Response.OriginalHeaders)
+	if content == nil || content.Text == "" {
+		content = &e.Response.Content
+		header = proxy.HARHeader(e.Response.Headers)
+		header.Del("Content-Encoding")
+	}
+	if content.Text == "" {
+		return nil, nil, fmt.Errorf("no body recorded")
+	}
+	body, err := content.Body()
+	if err != nil {
+		return nil, nil, err
+	}
+	header.Del("Content-Length")
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", content.MimeType)
+	}
+
+	u, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	headers := proxy.HARHeader(e.Request.Headers)
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Response.Status, e.Response.StatusText),
+		StatusCode:    e.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request: &http.Request{
+			Method: e.Request.Method,
+			URL:    u,
+			Header: headers,
+		},
+	}
+	return resp, headers, nil
+}
+
+func withWebP(accept string) string {
+	if accept = withoutWebP(accept); accept == "" {
+		return "image/webp"
+	}
+	return "image/webp," + accept
+}
+
+func withoutWebP(accept string) string {
+	var types []string
+	for _, v := range strings.Split(accept, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" && strings.TrimSpace(strings.SplitN(v, ";", 2)[0]) != "image/webp" {
+			types = append(types, v)
+		}
+	}
+	return strings.Join(types, ",")
+}
@@ -3,10 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/barnacs/compy/proxy"
 	tc "github.com/barnacs/compy/transcoder"
@@ -20,18 +25,108 @@ var (
 	caKey = flag.String("cakey", "", "CA key path")
 	user  = flag.String("user", "", "proxy user name")
 	pass  = flag.String("pass", "", "proxy password")
+	har   = flag.String("har", "", "directory to write HAR captures to, toggled from the proxy's local page")
+
+	harBodies = flag.Bool("harbodies", false, "include response bodies in HAR captures")
+	coalesce  = flag.Duration("coalesce", 0, "share the response to identical concurrent cacheable requests, waiting at most this long for it, e.g. 10s, 0 to disable")
 
 	brotli = flag.Int("brotli", 6, "Brotli compression level (0-11)")
+	brwin  = flag.Int("brotliwin", 0, "Brotli window size as base 2 logarithm (10-24, 0 for the default of 22)")
 	jpeg   = flag.Int("jpeg", 50, "jpeg quality (1-100, 0 to disable)")
+	avif   = flag.Int("avif", 50, "AVIF quality for jpeg, png and gif images (1-100, 0 to disable), requires building with -tags avif")
+	meta   = flag.Bool("keepmeta", false, "keep EXIF and XMP metadata in transcoded jpeg images")
+	prog   = flag.Bool("progressive", false, "encode progressive jpeg images, ignored in builds without cgo")
+	chroma = flag.String("subsample", "", "jpeg chroma subsampling (444, 422 or 420, empty for the encoder default), ignored in builds without cgo")
+	ssim   = flag.Float64("jpegssim", 0, "adaptive jpeg quality: lowest quality up to -jpeg keeping this SSIM (e.g. 0.95, 0 to disable)")
 	gif    = flag.Bool("gif", true, "transcode gifs into static images")
 	gzip   = flag.Int("gzip", 6, "gzip compression level (0-9)")
+	zstd   = flag.Int("zstd", 3, "zstd compression level (1-22, 0 to disable)")
 	png    = flag.Bool("png", true, "transcode png")
-	minify = flag.Bool("minify", false, "minify css/html/js - WARNING: tends to break the web")
+	pngq   = flag.Int("pnglossy", 0, "lossy png: WebP quality (1-100) and palette quantization, 0 for lossless only")
+	pngdb  = flag.Float64("pngpsnr", 40, "minimum quality of quantized png images as PSNR in dB, lower is smaller")
+	minify = flag.Bool("minify", false, "minify css/html/js with conservative settings, see -minifyrules to choose by host")
+	sniff  = flag.Bool("sniff", false, "detect the content type of responses with a missing, generic or wrong Content-Type")
+
+	lazyLoad     = flag.Bool("lazyload", false, "add loading=lazy and decoding=async to images and iframes in html")
+	maxSrcset    = flag.Int("maxsrcset", 0, "drop srcset candidates wider than this many pixels from html, 0 to keep all")
+	dropPreloads = flag.Bool("droppreloads", false, "remove preloads of images, fonts, audio and video from html")
+	dataURIs     = flag.Bool("datauris", false, "transcode base64 jpeg, png and gif images embedded in html and css")
+	inline       = flag.Int("inline", 0, "inline images up to this many bytes into html as data: URIs, 0 to disable")
+	inlineTime   = flag.Duration("inlinetimeout", time.Second, "maximum time spent fetching images to inline per html document")
+	placeholders = flag.Bool("placeholders", false, "allow replacing images with tiny previews, per client from the local page or per request with the "+proxy.PlaceholderHeader+" header")
+
+	avifSpeed = flag.Int("avifspeed", 8, "AVIF encoder speed (0-10, higher is faster but larger)")
+	avifJobs  = flag.Int("avifjobs", (runtime.NumCPU()+1)/2, "maximum concurrent AVIF encodes, WebP is served beyond that")
+
+	compressTypes = flag.String("compress", strings.Join(defaultCompressTypes, ","), "comma separated content types to brotli/gzip compress, wildcards and +suffixes allowed")
+	compressMin   = flag.Int("compressmin", 512, "minimum response size to compress in bytes")
+	zstdDict      = flag.String("zstddict", "", "zstd dictionary path to decode upstream responses compressed with it")
+	woff2         = flag.Bool("woff2", true, "convert ttf, otf and woff fonts to woff2 for clients supporting it")
+	fontSubset    = flag.String("fontsubset", "", "comma separated hosts (*.domain for subdomains, * for all) whose fonts are subset to latin characters")
+	svgRaster     = flag.Int("svgraster", 0, "rasterize svg images larger than this many bytes when smaller as png/webp, 0 to disable")
+	minifyRules   = flag.String("minifyrules", "", "minify rules path, lines of: <host|*.domain|*> <types|*> <off|on|aggressive>, the first match winning over -minify")
+	blocklists    = flag.String("blocklists", "", "comma separated Adblock Plus filter lists or hosts files to block requests and hide elements with")
 )
 
+// maxDataURI is the largest embedded image transcoded, in bytes of
+// base64, as it is held in memory.
+const maxDataURI = 4 << 20
+
+// defaultCompressTypes are compressed even without a content-specific
+// transcoder. Already compressed formats are skipped by tc.Zip.
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/x-javascript",
+	"application/ecmascript",
+	"application/json",
+	"+json",
+	"application/xml",
+	"+xml",
+	"application/xhtml+xml",
+	"application/x-www-form-urlencoded",
+	"application/wasm",
+	"application/vnd.ms-fontobject",
+	"application/x-font-ttf",
+	"application/x-font-otf",
+	"application/font-sfnt",
+	"font/ttf",
+	"font/otf",
+	"font/sfnt",
+	"font/collection",
+	"image/svg+xml",
+	"image/x-icon",
+	"image/vnd.microsoft.icon",
+	"image/bmp",
+}
+
+func init() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), `Usage of %s:
+  compy [flags]                     run the proxy
+  compy [flags] transcode [options] transcode local files, see transcode -h
+  compy [flags] bench [options]     compare settings on a HAR file, see bench -h
+
+Flags:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
 func main() {
 	flag.Parse()
 
+	switch flag.Arg(0) {
+	case "":
+	case "transcode":
+		os.Exit(transcodeCommand(flag.Args()[1:]))
+	case "bench":
+		os.Exit(benchCommand(flag.Args()[1:]))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	p := proxy.New(*host, *cert)
 
 	if (*ca == "") != (*caKey == "") {
@@ -55,28 +150,15 @@ func main() {
 		p.SetAuthentication(*user, *pass)
 	}
 
-	if *jpeg != 0 {
-		p.AddTranscoder("image/jpeg", tc.NewJpeg(*jpeg))
-	}
-	if *gif {
-		p.AddTranscoder("image/gif", &tc.Gif{})
-	}
-	if *png {
-		p.AddTranscoder("image/png", &tc.Png{})
+	if *har != "" {
+		p.EnableCapture(*har, *harBodies)
 	}
 
-	var ttc proxy.Transcoder
-	if *minify {
-		ttc = &tc.Zip{tc.NewMinifier(), *brotli, *gzip, false}
-	} else {
-		ttc = &tc.Zip{&tc.Identity{}, *brotli, *gzip, true}
+	if *coalesce > 0 {
+		p.EnableCoalescing(*coalesce)
 	}
 
-	p.AddTranscoder("text/css", ttc)
-	p.AddTranscoder("text/html", ttc)
-	p.AddTranscoder("text/javascript", ttc)
-	p.AddTranscoder("application/javascript", ttc)
-	p.AddTranscoder("application/x-javascript", ttc)
+	addTranscoders(p)
 
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt)
@@ -84,8 +166,9 @@ func main() {
 		for range c {
 			read := atomic.LoadUint64(&p.ReadCount)
 			written := atomic.LoadUint64(&p.WriteCount)
-			log.Printf("compy exiting, total transcoded: %d -> %d (%3.1f%%)",
-				read, written, float64(written)/float64(read)*100)
+			log.Printf("compy exiting, total transcoded: %d -> %d (%3.1f%%), blocked: %d requests, an estimated %d bytes avoided",
+				read, written, float64(written)/float64(read)*100,
+				atomic.LoadUint64(&p.BlockedCount), atomic.LoadUint64(&p.BlockedBytesEstimate))
 			os.Exit(0)
 		}
 	}()
@@ -100,3 +183,244 @@ func main() {
 	}
 	log.Fatalln(err)
 }
+
+// serverFlags configure the proxy rather than the transcoders.
+var serverFlags = map[string]bool{
+	"host": true, "cert": true, "key": true, "ca": true, "cakey": true,
+	"user": true, "pass": true, "har": true, "harbodies": true, "coalesce": true,
+}
+
+// transcoderSettings returns a hash of the flags the transcoders are set
+// up from.
+func transcoderSettings() string {
+	sum := fnv.New64a()
+	flag.VisitAll(func(f *flag.Flag) {
+		if !serverFlags[f.Name] {
+			fmt.Fprintf(sum, "%s=%s\n", f.Name, f.Value)
+		}
+	})
+	return fmt.Sprintf("%016x", sum.Sum64())
+}
+
+func addTranscoders(p *proxy.Proxy) {
+	p.SetSniffing(*sniff)
+	p.SetTranscoderSettings(transcoderSettings())
+
+	var blocker *proxy.Blocker
+	if *blocklists != "" {
+		blocker = proxy.NewBlocker()
+		for _, path := range strings.Split(*blocklists, ",") {
+			if path = strings.TrimSpace(path); path == "" {
+				continue
+			}
+			if err := blocker.LoadFile(path); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		log.Printf("loaded %d filters, skipped %d unsupported", blocker.Filters, blocker.Skipped)
+		p.EnableBlocking(blocker)
+	}
+
+	switch *chroma {
+	case "", "444", "422", "420":
+	default:
+		log.Fatalf("invalid chroma subsampling %q", *chroma)
+	}
+	if tc.ImageImplementation == "purego" && (*prog || *chroma != "") {
+		log.Printf("-progressive and -subsample are ignored in builds without cgo")
+	}
+	// the encode budget is shared by all image types
+	var avifSettings *tc.Avif
+	if *avif != 0 && tc.AvifSupported {
+		avifSettings = tc.NewAvif(*avif, *avifSpeed, *avifJobs)
+	}
+	images := make(map[string]proxy.Transcoder)
+	if *jpeg != 0 {
+		jpegTranscoder := tc.NewJpeg(*jpeg)
+		jpegTranscoder.KeepMetadata = *meta
+		jpegTranscoder.Progressive = *prog
+		jpegTranscoder.Subsampling = *chroma
+		jpegTranscoder.TargetSSIM = *ssim
+		jpegTranscoder.Avif = avifSettings
+		images["image/jpeg"] = jpegTranscoder
+	}
+	if *gif {
+		images["image/gif"] = &tc.Gif{Avif: avifSettings}
+	}
+	if *png {
+		images["image/png"] = &tc.Png{
+			LossyQuality: *pngq,
+			MinPSNR:      *pngdb,
+			Avif:         avifSettings,
+		}
+	}
+	if *placeholders {
+		p.EnablePlaceholders()
+		for _, contentType := range []string{"image/jpeg", "image/gif", "image/png", "image/webp"} {
+			t := images[contentType]
+			if t == nil {
+				t = &tc.Identity{}
+			}
+			images[contentType] = &tc.Placeholder{Transcoder: t}
+		}
+	}
+	for contentType, t := range images {
+		p.AddTranscoder(contentType, t)
+	}
+
+	var dict []byte
+	if *zstdDict != "" {
+		var err error
+		if dict, err = ioutil.ReadFile(*zstdDict); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	zip := &tc.Zip{
+		Transcoder:             &tc.Identity{},
+		BrotliCompressionLevel: *brotli,
+		BrotliWindow:           *brwin,
+		GzipCompressionLevel:   *gzip,
+		ZstdCompressionLevel:   *zstd,
+		ZstdDictionary:         dict,
+		SkipCompressed:         true,
+		MinSize:                *compressMin,
+	}
+	for _, contentType := range strings.Split(*compressTypes, ",") {
+		if contentType = strings.TrimSpace(contentType); contentType == "" {
+			continue
+		}
+		if err := p.AddTranscoderPriority(contentType, -1, zip); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	ttc := zip
+	var minifier *tc.Minifier
+	if *minify || *minifyRules != "" {
+		minifier = tc.NewMinifier()
+		if !*minify {
+			minifier.Default = tc.MinifyOff
+		}
+		if *minifyRules != "" {
+			f, err := os.Open(*minifyRules)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			minifier.Rules, err = tc.ParseMinifyRules(f)
+			f.Close()
+			if err != nil {
+				log.Fatalf("%s: %s", *minifyRules, err)
+			}
+		}
+		ttc = &tc.Zip{
+			Transcoder:             minifier,
+			BrotliCompressionLevel: *brotli,
+			BrotliWindow:           *brwin,
+			GzipCompressionLevel:   *gzip,
+			ZstdCompressionLevel:   *zstd,
+			ZstdDictionary:         dict,
+			SkipCompressed:         false,
+			MinSize:                *compressMin,
+		}
+	}
+
+	for _, contentType := range []string{
+		"text/css",
+		"text/html",
+		"text/javascript",
+		"application/javascript",
+		"application/x-javascript",
+	} {
+		p.AddTranscoder(contentType, ttc)
+	}
+	if minifier != nil {
+		for _, contentType := range []string{
+			"application/json",
+			"text/json",
+			"+json",
+			"application/xml",
+			"text/xml",
+			"+xml",
+		} {
+			p.AddTranscoder(contentType, ttc)
+		}
+	}
+	if minifier != nil || *svgRaster > 0 {
+		p.AddTranscoder("image/svg+xml", &tc.SVG{
+			Transcoder:    zip,
+			Minifier:      minifier,
+			RasterizeSize: *svgRaster,
+			Images:        p,
+		})
+	}
+
+	if *woff2 || *fontSubset != "" {
+		font := &tc.Font{Transcoder: zip, WOFF2: *woff2}
+		for _, host := range strings.Split(*fontSubset, ",") {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				font.LatinHosts = append(font.LatinHosts, host)
+			}
+		}
+		for _, contentType := range []string{
+			"font/ttf",
+			"font/otf",
+			"font/sfnt",
+			"font/woff",
+			"application/x-font-ttf",
+			"application/x-font-otf",
+			"application/font-sfnt",
+			"application/font-woff",
+			"application/x-font-woff",
+		} {
+			p.AddTranscoder(contentType, font)
+		}
+	}
+
+	// resources pages check the integrity of are sent unchanged
+	var integrity *tc.IntegrityURLs
+	if minifier != nil || *dataURIs {
+		integrity = tc.NewIntegrityURLs()
+	}
+	if minifier != nil {
+		minifier.Integrity = integrity
+	}
+
+	// the HTML specific transcoders run inside Zip, on the decoded markup
+	html := *ttc
+	if *lazyLoad || *maxSrcset > 0 || *dropPreloads || blocker != nil || *inline > 0 || integrity != nil {
+		rewriter := &tc.HTMLRewriter{
+			Transcoder:     html.Transcoder,
+			LazyLoad:       *lazyLoad,
+			MaxSrcsetWidth: *maxSrcset,
+			DropPreloads:   *dropPreloads,
+			Blocker:        blocker,
+			Integrity:      integrity,
+		}
+		if *inline > 0 {
+			rewriter.Inline = &tc.ImageInliner{
+				Images:  p,
+				MaxSize: *inline,
+				Timeout: *inlineTime,
+			}
+		}
+		html.Transcoder = rewriter
+	}
+	if *placeholders {
+		html.Transcoder = &tc.PlaceholderScript{Transcoder: html.Transcoder}
+	}
+	if *dataURIs {
+		// before the other transcoders, which may inline images already
+		// transcoded
+		html.Transcoder = &tc.DataURIs{Transcoder: html.Transcoder, Images: p, MaxSize: maxDataURI}
+		css := *ttc
+		css.Transcoder = &tc.DataURIs{Transcoder: css.Transcoder, Images: p, MaxSize: maxDataURI, Integrity: integrity}
+		css.SkipCompressed = false
+		p.AddTranscoder("text/css", &css)
+	}
+	if html.Transcoder != ttc.Transcoder {
+		// decode even if the client can't take a better encoding
+		html.SkipCompressed = false
+		p.AddTranscoder("text/html", &html)
+	}
+}
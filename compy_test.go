@@ -3,23 +3,45 @@ package main
 import (
 	. "gopkg.in/check.v1"
 
+	"bufio"
 	"bytes"
 	gzipp "compress/gzip"
+	"compress/zlib"
+	"crypto/md5"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
 	gifp "image/gif"
 	jpegp "image/jpeg"
 	pngp "image/png"
 	"io/ioutil"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/ahmetb/go-httpbin"
+	brotlip "github.com/andybalholm/brotli"
 	"github.com/barnacs/compy/proxy"
 	tc "github.com/barnacs/compy/transcoder"
-	"github.com/chai2010/webp"
-	brotlidec "gopkg.in/kothar/brotli-go.v0/dec"
+	zstdp "github.com/klauspost/compress/zstd"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/webp"
 )
 
 func Test(t *testing.T) {
@@ -29,19 +51,44 @@ func Test(t *testing.T) {
 type CompyTest struct {
 	client *http.Client
 	server *httptest.Server
+	origin *httptest.Server
 	proxy  *proxy.Proxy
+	harDir string
 }
 
 var _ = Suite(&CompyTest{})
 
 func (s *CompyTest) SetUpSuite(c *C) {
 	s.server = httptest.NewServer(httpbin.GetMux())
+	s.origin = httptest.NewServer(originMux())
 
 	s.proxy = proxy.New("localhost"+*host, "")
-	s.proxy.AddTranscoder("image/gif", &tc.Gif{})
-	s.proxy.AddTranscoder("image/jpeg", tc.NewJpeg(50))
-	s.proxy.AddTranscoder("image/png", &tc.Png{})
-	s.proxy.AddTranscoder("text/html", &tc.Zip{&tc.Identity{}, *brotli, *gzip, true})
+	s.harDir = c.MkDir()
+	s.proxy.EnableCapture(s.harDir, true)
+	s.proxy.SetSniffing(true)
+	s.proxy.EnablePlaceholders()
+	blocker := proxy.NewBlocker()
+	c.Assert(blocker.Load(strings.NewReader(testFilters)), IsNil)
+	s.proxy.EnableBlocking(blocker)
+	s.proxy.AddTranscoderPriority("+json", -1, &tc.Zip{
+		Transcoder:           &tc.Identity{},
+		GzipCompressionLevel: *gzip,
+		SkipCompressed:       true,
+		MinSize:              512,
+	})
+	avif := tc.NewAvif(50, 10, 1)
+	s.proxy.AddTranscoder("image/gif", &tc.Gif{Avif: avif})
+	jpeg := tc.NewJpeg(50)
+	jpeg.Avif = avif
+	s.proxy.AddTranscoder("image/jpeg", &tc.Placeholder{Transcoder: jpeg})
+	s.proxy.AddTranscoder("image/png", &tc.Png{Avif: avif})
+	s.proxy.AddTranscoder("text/html", &tc.Zip{
+		Transcoder:             &tc.PlaceholderScript{Transcoder: &tc.Identity{}},
+		BrotliCompressionLevel: *brotli,
+		GzipCompressionLevel:   *gzip,
+		ZstdCompressionLevel:   *zstd,
+		SkipCompressed:         true,
+	})
 	go func() {
 		err := s.proxy.Start(*host)
 		if err != nil {
@@ -59,10 +106,58 @@ func (s *CompyTest) SetUpSuite(c *C) {
 
 func (s *CompyTest) TearDownSuite(c *C) {
 	s.server.Close()
+	s.origin.Close()
 
 	// TODO: Go 1.8 will provide http.Server.Shutdown for proxy.Proxy
 }
 
+// originMux serves responses httpbin can't produce, e.g. with arbitrary
+// Content-Type headers: /<path>?type=<content type>[&cc=<cache control>],
+// with ranges=1 to serve byte ranges and etag=<etag> for conditional
+// requests
+func originMux() *http.ServeMux {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	var pngData bytes.Buffer
+	pngp.Encode(&pngData, img)
+
+	bodies := map[string][]byte{
+		"/png":      pngData.Bytes(),
+		"/flat.png": flatPng(),
+		"/html":     []byte("<!DOCTYPE html><html><body>not an image</body></html>"),
+		"/json":     []byte(`{"small":true}`),
+		"/big.json": []byte("[" + strings.Repeat(`{"big":true},`, 200) + "{}]"),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header()["Content-Type"] = []string{r.URL.Query().Get("type")}
+		if r.URL.Query().Get("nosniff") != "" {
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+		if cc := r.URL.Query().Get("cc"); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		if etag := r.URL.Query().Get("etag"); etag != "" {
+			sum := md5.Sum(body)
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		if r.URL.Query().Get("ranges") != "" || r.URL.Query().Get("etag") != "" {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+			return
+		}
+		w.Write(body)
+	})
+	return mux
+}
+
 func (s *CompyTest) TestHttpBin(c *C) {
 	resp, err := s.client.Get(s.server.URL + "/status/200")
 	c.Assert(err, IsNil)
@@ -109,10 +204,76 @@ func (s *CompyTest) TestBrotli(c *C) {
 	c.Assert(resp.StatusCode, Equals, 200)
 	c.Assert(resp.Header.Get("Content-Encoding"), Equals, "br")
 
-	brr := brotlidec.NewBrotliReader(resp.Body)
-	defer brr.Close()
-	_, err = ioutil.ReadAll(brr)
+	_, err = ioutil.ReadAll(brotlip.NewReader(resp.Body))
+	c.Assert(err, IsNil)
+}
+
+func (s *CompyTest) TestZstd(c *C) {
+	req, err := http.NewRequest("GET", s.server.URL+"/html", nil)
+	c.Assert(err, IsNil)
+	req.Header.Add("Accept-Encoding", "gzip, br, zstd")
+
+	resp, err := s.client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 200)
+	c.Assert(resp.Header.Get("Content-Encoding"), Equals, "zstd")
+
+	zr, err := zstdp.NewReader(resp.Body)
+	c.Assert(err, IsNil)
+	defer zr.Close()
+	body, err := ioutil.ReadAll(zr)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Matches, "(?s).*Herman Melville.*")
+}
+
+func (s *CompyTest) TestEncodingPreference(c *C) {
+	req, err := http.NewRequest("GET", s.server.URL+"/html", nil)
+	c.Assert(err, IsNil)
+	req.Header.Add("Accept-Encoding", "zstd;q=0.5, br;q=0.8, gzip")
+
+	resp, err := s.client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 200)
+	c.Assert(resp.Header.Get("Content-Encoding"), Equals, "gzip")
+}
+
+func (s *CompyTest) TestEncodingNegotiation(c *C) {
+	for acceptEncoding, encoding := range map[string]string{
+		"gzip,br":                "br",
+		"GZIP ,  BR;q=0.5":       "gzip",
+		"br;q=0, gzip":           "gzip",
+		"br;q=0":                 "",
+		"*":                      "zstd",
+		"*;q=0.5, zstd;q=0.1":    "br",
+		"identity":               "",
+		"identity, gzip;q=0.5":   "",
+		"identity;q=0, gzip;q=0": "",
+	} {
+		req, err := http.NewRequest("GET", s.server.URL+"/html", nil)
+		c.Assert(err, IsNil)
+		req.Header.Add("Accept-Encoding", acceptEncoding)
+
+		resp, err := s.client.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(resp.Header.Get("Content-Encoding"), Equals, encoding, Commentf(acceptEncoding))
+		c.Assert(resp.Header.Get("Vary"), Equals, "Accept-Encoding")
+	}
+}
+
+func (s *CompyTest) TestIdentityRefused(c *C) {
+	req, err := http.NewRequest("GET", s.origin.URL+"/json?type=application/vnd.api%2Bjson", nil)
 	c.Assert(err, IsNil)
+	req.Header.Add("Accept-Encoding", "gzip, identity;q=0")
+
+	resp, err := s.client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 200)
+	c.Assert(resp.Header.Get("Content-Encoding"), Equals, "gzip")
 }
 
 func (s *CompyTest) TestGif(c *C) {
@@ -144,11 +305,39 @@ func (s *CompyTest) TestGifToWebP(c *C) {
 	defer resp.Body.Close()
 	c.Assert(resp.StatusCode, Equals, 200)
 	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/webp")
+	c.Assert(resp.Header.Get("Vary"), Equals, "Accept")
 
 	_, err = webp.Decode(resp.Body)
 	c.Assert(err, IsNil)
 }
 
+func (s *CompyTest) TestWebPNegotiation(c *C) {
+	types := []string{"image/png"}
+	if tc.LossyWebP {
+		// without lossy WebP, jpeg images are never converted
+		types = append(types, "image/jpeg")
+	}
+	for _, original := range types {
+		for accept, contentType := range map[string]string{
+			"image/webp;q=0.5," + original: "image/webp",
+			"IMAGE/WEBP":                   "image/webp",
+			"image/webp;q=0":               original,
+			"image/*":                      original,
+			"*/*":                          original,
+		} {
+			req, err := http.NewRequest("GET", s.server.URL+"/"+original, nil)
+			c.Assert(err, IsNil)
+			req.Header.Add("Accept", accept)
+
+			resp, err := s.client.Do(req)
+			c.Assert(err, IsNil)
+			resp.Body.Close()
+			c.Assert(resp.StatusCode, Equals, 200)
+			c.Assert(resp.Header.Get("Content-Type"), Equals, contentType, Commentf("%s %s", original, accept))
+		}
+	}
+}
+
 func (s *CompyTest) TestJpeg(c *C) {
 	resp, err := s.client.Get(s.server.URL + "/image/jpeg")
 	c.Assert(err, IsNil)
@@ -189,6 +378,9 @@ func (s *CompyTest) TestJpegQuality(c *C) {
 }
 
 func (s *CompyTest) TestJpegToWebP(c *C) {
+	if !tc.LossyWebP {
+		c.Skip("lossy WebP encoding requires cgo")
+	}
 	req, err := http.NewRequest("GET", s.server.URL+"/image/jpeg", nil)
 	c.Assert(err, IsNil)
 	req.Header.Add("Accept", "image/webp,image/jpeg")
@@ -203,6 +395,37 @@ func (s *CompyTest) TestJpegToWebP(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *CompyTest) TestAvifNegotiation(c *C) {
+	for _, original := range []string{"image/jpeg", "image/png", "image/gif"} {
+		avif, webp, avifOnly := original, original, original
+		if tc.LossyWebP || original != "image/jpeg" {
+			avif, webp = "image/webp", "image/webp"
+		}
+		if tc.AvifSupported {
+			avif, avifOnly = "image/avif", "image/avif"
+		}
+		for accept, expected := range map[string]string{
+			"image/avif,image/webp,*/*":       avif,
+			"image/webp,image/avif,image/*":   avif,
+			"image/avif;q=0.5,image/webp":     webp,
+			"image/avif,image/webp;q=0":       avifOnly,
+			"image/avif;q=0,image/webp;q=0.1": webp,
+			"image/*":                         original,
+		} {
+			req, err := http.NewRequest("GET", s.server.URL+"/"+original, nil)
+			c.Assert(err, IsNil)
+			req.Header.Add("Accept", accept)
+			resp, err := s.client.Do(req)
+			c.Assert(err, IsNil)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			c.Assert(err, IsNil)
+			c.Assert(resp.Header.Get("Content-Type"), Equals, expected, Commentf("%s, Accept: %s", original, accept))
+			c.Assert(len(body) > 0, Equals, true)
+		}
+	}
+}
+
 func (s *CompyTest) TestPng(c *C) {
 	resp, err := s.client.Get(s.server.URL + "/image/png")
 	c.Assert(err, IsNil)
@@ -213,6 +436,257 @@ func (s *CompyTest) TestPng(c *C) {
 	_, err = pngp.Decode(resp.Body)
 	c.Assert(err, IsNil)
 }
+
+// noisyPng returns a noisy truecolor PNG with a transparent corner.
+func noisyPng() []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 128, 128))
+	noise := uint32(1)
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			a := uint8(255)
+			if x < 16 && y < 16 {
+				a = 0
+			}
+			noise = noise*1664525 + 1013904223
+			n := uint8(noise >> 28)
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x) + n, uint8(y) + n, uint8(x+y) / 2, a})
+		}
+	}
+	var buf bytes.Buffer
+	pngp.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func transcodePng(c *C, t *tc.Png, accept string) *proxy.ResponseBuffer {
+	return transcodeImage(c, t, "image/png", noisyPng(), accept)
+}
+
+func transcodeImage(c *C, t proxy.Transcoder, contentType string, body []byte, accept string) *proxy.ResponseBuffer {
+	p := proxy.New("", "")
+	p.AddTranscoder(contentType, t)
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}
+	buf := proxy.NewResponseBuffer()
+	_, _, err := p.TranscodeResponse(buf, resp, http.Header{"Accept": {accept}})
+	c.Assert(err, IsNil)
+	return buf
+}
+
+func (s *CompyTest) TestPngQuantize(c *C) {
+	lossless := transcodePng(c, &tc.Png{}, "image/png")
+	buf := transcodePng(c, &tc.Png{LossyQuality: 75, MinPSNR: 30}, "image/png")
+	c.Assert(buf.Header().Get("Content-Type"), Equals, "image/png")
+	c.Assert(buf.Len() < lossless.Len(), Equals, true)
+	img, err := pngp.Decode(buf)
+	c.Assert(err, IsNil)
+	paletted, ok := img.(*image.Paletted)
+	c.Assert(ok, Equals, true)
+	c.Assert(len(paletted.Palette) <= 256, Equals, true)
+	_, _, _, a := img.At(0, 0).RGBA()
+	c.Assert(a, Equals, uint32(0))
+	_, _, _, a = img.At(64, 64).RGBA()
+	c.Assert(a, Equals, uint32(0xffff))
+
+	// not close enough to the original
+	buf = transcodePng(c, &tc.Png{LossyQuality: 75, MinPSNR: 80}, "image/png")
+	img, err = pngp.Decode(buf)
+	c.Assert(err, IsNil)
+	_, ok = img.(*image.Paletted)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *CompyTest) TestPngLossyWebP(c *C) {
+	if !tc.LossyWebP {
+		c.Skip("lossy WebP encoding requires cgo")
+	}
+	lossless := transcodePng(c, &tc.Png{}, "image/webp")
+	buf := transcodePng(c, &tc.Png{LossyQuality: 75}, "image/webp")
+	c.Assert(buf.Header().Get("Content-Type"), Equals, "image/webp")
+	c.Assert(buf.Len() < lossless.Len(), Equals, true)
+	img, err := webp.Decode(buf)
+	c.Assert(err, IsNil)
+	_, _, _, a := img.At(0, 0).RGBA()
+	c.Assert(a, Equals, uint32(0))
+}
+
+// orientedJpeg returns a 32x16 JPEG, white on the left and black on the
+// right, with an EXIF orientation of 6 (rotate 90° clockwise).
+func orientedJpeg() []byte {
+	img := image.NewGray(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			img.SetGray(x, y, color.Gray{255})
+		}
+	}
+	var buf bytes.Buffer
+	jpegp.Encode(&buf, img, nil)
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08" +
+		"\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	segment := append([]byte{0xFF, 0xE1, 0, byte(len(exif) + 2)}, exif...)
+	return append(append(buf.Bytes()[:2:2], segment...), buf.Bytes()[2:]...)
+}
+
+func (s *CompyTest) TestJpegOrientation(c *C) {
+	buf := transcodeImage(c, tc.NewJpeg(90), "image/jpeg", orientedJpeg(), "image/jpeg")
+	c.Assert(bytes.Contains(buf.Bytes(), []byte("Exif")), Equals, false)
+	img, err := jpegp.Decode(buf)
+	c.Assert(err, IsNil)
+	c.Assert(img.Bounds().Dx(), Equals, 16)
+	c.Assert(img.Bounds().Dy(), Equals, 32)
+	// the white left half is now on top
+	top, _, _, _ := img.At(8, 4).RGBA()
+	bottom, _, _, _ := img.At(8, 28).RGBA()
+	c.Assert(top > 0xe000 && bottom < 0x2000, Equals, true)
+
+	jpeg := tc.NewJpeg(90)
+	jpeg.KeepMetadata = true
+	buf = transcodeImage(c, jpeg, "image/jpeg", orientedJpeg(), "image/jpeg")
+	c.Assert(bytes.Contains(buf.Bytes(), []byte("Exif")), Equals, true)
+	c.Assert(bytes.Contains(buf.Bytes(), []byte("\x01\x12\x00\x03\x00\x00\x00\x01\x00\x01")), Equals, true)
+	img, err = jpegp.Decode(buf)
+	c.Assert(err, IsNil)
+	c.Assert(img.Bounds().Dx(), Equals, 16)
+}
+
+func (s *CompyTest) TestJpegMalformedSegment(c *C) {
+	jpeg := tc.NewJpeg(90)
+	jpeg.KeepMetadata = true
+	p := proxy.New("", "")
+	p.AddTranscoder("image/jpeg", jpeg)
+	for _, segment := range []string{"\xFF\xE1\x00\x00", "\xFF\xE1\x00\x01", "\xFF\xE1\xFF\xFF"} {
+		body := append([]byte("\xFF\xD8"+segment), orientedJpeg()[2:]...)
+		resp := &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": {"image/jpeg"}},
+			Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		}
+		// whether the decoder accepts it depends on the codec, reading the
+		// metadata mustn't panic
+		p.TranscodeResponse(proxy.NewResponseBuffer(), resp, http.Header{"Accept": {"image/jpeg"}})
+	}
+}
+
+// photoJpeg returns a JPEG with smooth gradients and some noise.
+func photoJpeg() []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 128, 128))
+	noise := uint32(1)
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			noise = noise*1664525 + 1013904223
+			// texture in every channel, as smooth gradients survive any quality
+			n := uint8(noise >> 26)
+			img.SetRGBA(x, y, color.RGBA{uint8(x*2) + n, uint8(y*2) + n, uint8(255-x-y/2) + n/2, 255})
+		}
+	}
+	var buf bytes.Buffer
+	jpegp.Encode(&buf, img, &jpegp.Options{Quality: 95})
+	return buf.Bytes()
+}
+
+func (s *CompyTest) TestJpegOptions(c *C) {
+	if tc.ImageImplementation != "cgo" {
+		c.Skip("progressive encoding and chroma subsampling require libjpeg")
+	}
+	jpeg := tc.NewJpeg(80)
+	jpeg.Progressive = true
+	jpeg.Subsampling = "444"
+	buf := transcodeImage(c, jpeg, "image/jpeg", photoJpeg(), "image/jpeg")
+	// start of frame, progressive DCT
+	c.Assert(bytes.Contains(buf.Bytes(), []byte{0xFF, 0xC2}), Equals, true)
+	img, err := jpegp.Decode(buf)
+	c.Assert(err, IsNil)
+	c.Assert(img.(*image.YCbCr).SubsampleRatio, Equals, image.YCbCrSubsampleRatio444)
+
+	jpeg.Progressive = false
+	jpeg.Subsampling = "422"
+	buf = transcodeImage(c, jpeg, "image/jpeg", photoJpeg(), "image/jpeg")
+	c.Assert(bytes.Contains(buf.Bytes(), []byte{0xFF, 0xC2}), Equals, false)
+	img, err = jpegp.Decode(buf)
+	c.Assert(err, IsNil)
+	c.Assert(img.(*image.YCbCr).SubsampleRatio, Equals, image.YCbCrSubsampleRatio422)
+}
+
+func (s *CompyTest) TestJpegAdaptiveQuality(c *C) {
+	fixed := transcodeImage(c, tc.NewJpeg(90), "image/jpeg", photoJpeg(), "image/jpeg")
+
+	// the quality, and so the size, follows the target
+	jpeg := tc.NewJpeg(90)
+	size := 0
+	for _, target := range []float64{0.8, 0.9, 0.95} {
+		jpeg.TargetSSIM = target
+		adaptive := transcodeImage(c, jpeg, "image/jpeg", photoJpeg(), "image/jpeg")
+		c.Assert(adaptive.Len() > size, Equals, true, Commentf("SSIM %v", target))
+		c.Assert(adaptive.Len() < fixed.Len(), Equals, true, Commentf("SSIM %v", target))
+		size = adaptive.Len()
+	}
+
+	// unreachable, so the configured quality is the limit
+	jpeg.TargetSSIM = 1.1
+	adaptive := transcodeImage(c, jpeg, "image/jpeg", photoJpeg(), "image/jpeg")
+	c.Assert(adaptive.Len(), Equals, fixed.Len())
+}
+
+// swappedPng returns a pure red PNG whose color profile has the red and
+// green primaries of sRGB swapped, so it should look green.
+func swappedPng() []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []byte{255, 0, 0, 255})
+	}
+	var buf bytes.Buffer
+	pngp.Encode(&buf, img)
+
+	profile := make([]byte, 132+6*12)
+	copy(profile[16:], "RGB XYZ ")
+	binary.BigEndian.PutUint32(profile[128:], 6)
+	primaries := map[string][3]float64{
+		"rXYZ": {0.3851, 0.7169, 0.0971},
+		"gXYZ": {0.4361, 0.2225, 0.0139},
+		"bXYZ": {0.1431, 0.0606, 0.7141},
+	}
+	trc := len(profile)
+	profile = append(profile, "curv\x00\x00\x00\x00\x00\x00\x00\x00"...)
+	for i, tag := range []string{"rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"} {
+		entry := profile[132+12*i:]
+		copy(entry, tag)
+		offset, size := trc, 12
+		if xyz, ok := primaries[tag]; ok {
+			offset, size = len(profile), 20
+			profile = append(profile, "XYZ \x00\x00\x00\x00"...)
+			for _, v := range xyz {
+				profile = binary.BigEndian.AppendUint32(profile, uint32(int32(v*65536)))
+			}
+		}
+		binary.BigEndian.PutUint32(entry[4:], uint32(offset))
+		binary.BigEndian.PutUint32(entry[8:], uint32(size))
+	}
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(profile)
+	zw.Close()
+	chunk := append([]byte("iCCPswapped\x00\x00"), compressed.Bytes()...)
+	iccp := binary.BigEndian.AppendUint32(nil, uint32(len(chunk)-4))
+	iccp = append(iccp, chunk...)
+	iccp = binary.BigEndian.AppendUint32(iccp, crc32.ChecksumIEEE(chunk))
+
+	// after the signature and IHDR
+	b := buf.Bytes()
+	return append(append(b[:33:33], iccp...), b[33:]...)
+}
+
+func (s *CompyTest) TestColorProfile(c *C) {
+	buf := transcodeImage(c, &tc.Png{}, "image/png", swappedPng(), "image/png")
+	c.Assert(bytes.Contains(buf.Bytes(), []byte("iCCP")), Equals, false)
+	img, err := pngp.Decode(buf)
+	c.Assert(err, IsNil)
+	r, g, b, _ := img.At(4, 4).RGBA()
+	c.Assert([]uint32{r >> 8, g >> 8, b >> 8}, DeepEquals, []uint32{0, 255, 0})
+}
+
 func (s *CompyTest) TestPngToWebP(c *C) {
 	req, err := http.NewRequest("GET", s.server.URL+"/image/png", nil)
 	c.Assert(err, IsNil)
@@ -259,6 +733,29 @@ func (s *CompyTest) TestAuthentication(c *C) {
 	c.Assert(resp.StatusCode, Equals, 200)
 }
 
+func (s *CompyTest) TestAdminAuthentication(c *C) {
+	s.proxy.SetAuthentication("user", "pass")
+	defer s.proxy.SetAuthentication("", "")
+
+	for _, path := range []string{"/capture", "/placeholders"} {
+		resp, err := s.client.PostForm("http://localhost"+*host+path,
+			url.Values{"scope": {"client"}, "action": {"start"}})
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Check(resp.StatusCode, Equals, 407, Commentf("%s", path))
+	}
+
+	// the form is checked once authenticated
+	req, err := http.NewRequest("POST", "http://localhost"+*host+"/placeholders", strings.NewReader("action=bad"))
+	c.Assert(err, IsNil)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")))
+	resp, err := s.client.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 400)
+}
+
 func (s *CompyTest) TestAdmin(c *C) {
 	resp, err := s.client.Get("http://localhost" + *host)
 	c.Assert(err, IsNil)
@@ -275,3 +772,1367 @@ func (s *CompyTest) TestAdmin(c *C) {
 	defer resp.Body.Close()
 	c.Assert(resp.StatusCode, Equals, 501)
 }
+
+func (s *CompyTest) TestHarCapture(c *C) {
+	capture := func(action string) {
+		resp, err := s.client.PostForm("http://localhost"+*host+"/capture",
+			url.Values{"scope": {"client"}, "action": {action}})
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, 200)
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	capture("start")
+	resp, err := s.client.Get(s.server.URL + "/image/png")
+	c.Assert(err, IsNil)
+	_, err = ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	resp, err = s.client.Get(down.URL + "/gone")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	capture("stop")
+
+	files, err := filepath.Glob(filepath.Join(s.harDir, "*.har"))
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	har, err := proxy.ReadHAR(files[0])
+	c.Assert(err, IsNil)
+	c.Assert(har.Log.Entries, HasLen, 2)
+
+	failed := har.Log.Entries[1]
+	c.Assert(failed.Request.URL, Equals, down.URL+"/gone")
+	c.Assert(failed.Response.Status, Equals, 0)
+	c.Assert(failed.Error, Not(Equals), "")
+
+	// restarting right away doesn't overwrite the capture
+	capture("start")
+	capture("stop")
+	capture("start")
+	capture("stop")
+	files, err = filepath.Glob(filepath.Join(s.harDir, "*.har"))
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 3)
+	har, err = proxy.ReadHAR(files[0])
+	c.Assert(err, IsNil)
+	c.Assert(har.Log.Entries, HasLen, 2)
+
+	entry := har.Log.Entries[0]
+	c.Assert(entry.Request.URL, Equals, s.server.URL+"/image/png")
+	c.Assert(entry.Response.Status, Equals, 200)
+	c.Assert(entry.Response.Content.MimeType, Equals, "image/png")
+	c.Assert(entry.Response.Original.Size > 0, Equals, true)
+	original, err := entry.Response.Original.Body()
+	c.Assert(err, IsNil)
+	c.Assert(int64(len(original)), Equals, entry.Response.Original.Size)
+	_, err = pngp.Decode(bytes.NewReader(original))
+	c.Assert(err, IsNil)
+}
+
+func (s *CompyTest) TestTranscodeCommand(c *C) {
+	in, out := c.MkDir(), c.MkDir()
+	page := strings.Repeat("<p>compy transcodes local files</p>\n", 100)
+	c.Assert(os.MkdirAll(filepath.Join(in, "sub"), 0755), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(in, "img.png"), noisyPng(), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(in, "sub", "page.html"), []byte(page), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(in, "data.bin"), []byte("raw"), 0644), IsNil)
+
+	status := transcodeCommand([]string{"-accept", "image/webp", "-accept-encoding", "gzip", "-out", out, in})
+	c.Assert(status, Equals, 0)
+
+	data, err := ioutil.ReadFile(filepath.Join(out, "img.webp"))
+	c.Assert(err, IsNil)
+	_, err = webp.Decode(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(filepath.Join(out, "sub", "page.html.gz"))
+	c.Assert(err, IsNil)
+	gr, err := gzipp.NewReader(bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadAll(gr)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, page)
+	data, err = ioutil.ReadFile(filepath.Join(out, "data.bin"))
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "raw")
+
+	c.Assert(transcodeCommand([]string{filepath.Join(in, "missing.png")}), Equals, 1)
+}
+
+func (s *CompyTest) TestTranscodeResponse(c *C) {
+	p := proxy.New("", "")
+	p.AddTranscoder("image/png", &tc.Png{})
+	body := noisyPng()
+	resp := &http.Response{
+		StatusCode: http.StatusNotFound,
+		Header:     http.Header{"Content-Type": {"image/png"}, "X-Origin": {"kept"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    httptest.NewRequest("GET", "http://example.com/missing.png", nil),
+	}
+	buf := proxy.NewResponseBuffer()
+	read, written, err := p.TranscodeResponse(buf, resp, http.Header{"Accept": {"image/webp"}})
+	c.Assert(err, IsNil)
+	c.Assert(buf.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(buf.Header().Get("Content-Type"), Equals, "image/webp")
+	c.Assert(buf.Header().Get("X-Origin"), Equals, "kept")
+	c.Assert(read, Equals, uint64(len(body)))
+	c.Assert(written, Equals, uint64(buf.Len()))
+}
+
+func (s *CompyTest) TestPercent(c *C) {
+	c.Assert(percent(50, 200), Equals, 25.0)
+	c.Assert(percent(0, 0), Equals, 0.0)
+	c.Assert(percent(10, 0), Equals, 0.0)
+}
+
+func (s *CompyTest) TestBenchCombinations(c *C) {
+	for _, t := range []struct {
+		matrix matrixFlag
+		want   []string
+	}{
+		{nil, []string{"defaults"}},
+		{matrixFlag{{"jpeg", []string{"30", "50"}}}, []string{"jpeg=30", "jpeg=50"}},
+		{
+			matrixFlag{{"jpeg", []string{"30", "50"}}, {"webp", []string{"on", "off"}}},
+			[]string{"jpeg=30 webp=on", "jpeg=30 webp=off", "jpeg=50 webp=on", "jpeg=50 webp=off"},
+		},
+	} {
+		var got []string
+		for _, s := range t.matrix.combinations() {
+			got = append(got, s.String())
+		}
+		c.Check(got, DeepEquals, t.want, Commentf("%s", &t.matrix))
+	}
+}
+
+func (s *CompyTest) TestBenchWebP(c *C) {
+	for _, t := range []struct {
+		accept, with, without string
+	}{
+		{"", "image/webp", ""},
+		{"image/webp", "image/webp", ""},
+		{"image/avif,image/webp,*/*", "image/webp,image/avif,*/*", "image/avif,*/*"},
+		{"image/webp;q=0.9, image/png", "image/webp,image/png", "image/png"},
+		{"*/*", "image/webp,*/*", "*/*"},
+	} {
+		c.Check(withWebP(t.accept), Equals, t.with, Commentf(t.accept))
+		c.Check(withoutWebP(t.accept), Equals, t.without, Commentf(t.accept))
+	}
+}
+
+func (s *CompyTest) TestBenchRestoresFlags(c *C) {
+	before := flag.Lookup("jpeg").Value.String()
+	_, _, err := benchSettings(settings{"jpeg=30", "webp=on"}, nil, "", "")
+	c.Assert(err, IsNil)
+	c.Assert(flag.Lookup("jpeg").Value.String(), Equals, before)
+
+	_, _, err = benchSettings(settings{"jpeg=30", "nosuchflag=1"}, nil, "", "")
+	c.Assert(err, NotNil)
+	c.Assert(flag.Lookup("jpeg").Value.String(), Equals, before)
+}
+
+func (s *CompyTest) getPlaceholder(c *C, mode string, headers http.Header) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", s.server.URL+"/image/jpeg", nil)
+	c.Assert(err, IsNil)
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	if mode != "" {
+		req.Header.Set(proxy.PlaceholderHeader, mode)
+	}
+	resp, err := s.client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	return resp, body
+}
+
+func (s *CompyTest) TestPlaceholder(c *C) {
+	resp, body := s.getPlaceholder(c, "", nil)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/jpeg")
+	img, err := jpegp.Decode(bytes.NewReader(body))
+	c.Assert(err, IsNil)
+
+	resp, body = s.getPlaceholder(c, "on", nil)
+	c.Assert(resp.StatusCode, Equals, 200)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/svg+xml")
+	c.Assert(resp.Header.Get("Cache-Control"), Equals, "no-store")
+	c.Assert(len(body) < 1024, Equals, true)
+	size := fmt.Sprintf(`width="%d" height="%d"`, img.Bounds().Dx(), img.Bounds().Dy())
+	c.Assert(strings.Contains(string(body), size), Equals, true)
+}
+
+func (s *CompyTest) TestPlaceholderClient(c *C) {
+	placeholders := func(action string) {
+		resp, err := s.client.PostForm("http://localhost"+*host+"/placeholders",
+			url.Values{"action": {action}})
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, 200)
+	}
+	placeholders("on")
+	resp, _ := s.getPlaceholder(c, "", nil)
+	c.Check(resp.Header.Get("Content-Type"), Equals, "image/svg+xml")
+	// tapped placeholders
+	resp, _ = s.getPlaceholder(c, "off", nil)
+	c.Check(resp.Header.Get("Content-Type"), Equals, "image/jpeg")
+	placeholders("off")
+	resp, _ = s.getPlaceholder(c, "", nil)
+	c.Check(resp.Header.Get("Content-Type"), Equals, "image/jpeg")
+}
+
+func (s *CompyTest) TestPlaceholderScript(c *C) {
+	get := func(mode string) string {
+		req, err := http.NewRequest("GET", s.server.URL+"/html", nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Accept", "text/html")
+		req.Header.Set(proxy.PlaceholderHeader, mode)
+		resp, err := s.client.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return string(body)
+	}
+	c.Assert(strings.HasSuffix(get("on"), "</script>"), Equals, true)
+	c.Assert(strings.Contains(get("on"), proxy.PlaceholderParam), Equals, true)
+	c.Assert(strings.Contains(get("off"), proxy.PlaceholderParam), Equals, false)
+}
+
+func (s *CompyTest) TestPlaceholderParam(c *C) {
+	resp, err := s.client.PostForm("http://localhost"+*host+"/placeholders", url.Values{"action": {"on"}})
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	defer s.client.PostForm("http://localhost"+*host+"/placeholders", url.Values{"action": {"off"}})
+
+	// tapped placeholders
+	resp, err = s.client.Get(s.server.URL + "/image/jpeg?" + proxy.PlaceholderParam + "=off")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/jpeg")
+
+	// neither the parameter nor compy's headers reach the origin
+	req, err := http.NewRequest("GET", s.server.URL+"/get?a=1&"+proxy.PlaceholderParam+"=off&b=%20", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set(proxy.PlaceholderHeader, "on")
+	req.Header.Set("X-Compy-Quality", "10")
+	resp, err = s.client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	var echo struct {
+		Args    map[string]string
+		Headers map[string]string
+	}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&echo), IsNil)
+	c.Assert(echo.Args, DeepEquals, map[string]string{"a": "1", "b": " "})
+	for name := range echo.Headers {
+		c.Assert(strings.HasPrefix(strings.ToLower(name), "x-compy-"), Equals, false, Commentf(name))
+	}
+}
+
+const rewriteInput = `<!DOCTYPE html><html><head>
+<link rel="preload" href="/hero.jpg" as="image"><link rel=preload href=/app.js as=script>
+<link rel="stylesheet" href="/a.css?x=1&amp;y=2">
+</head><body>
+<img src="a.jpg" srcset="a-480.jpg 480w, a-960.jpg 960w, data:image/png;base64,AA,BB 1920w" alt="A &amp; B">
+<img src="hero.jpg" fetchpriority="high"><img src=b.jpg loading=eager srcset="b-2000.jpg 2000w,b-3000.jpg 3000w">
+<iframe src="/embed"></iframe><script>if (a < b) document.write("<img src=x>")</script>
+</body></html>`
+
+const rewriteOutput = `<!DOCTYPE html><html><head>
+<link rel=preload href=/app.js as=script>
+<link rel="stylesheet" href="/a.css?x=1&amp;y=2">
+</head><body>
+<img src="a.jpg" srcset="a-480.jpg 480w, a-960.jpg 960w" alt="A &amp; B" loading="lazy" decoding="async">
+<img src="hero.jpg" fetchpriority="high"><img src=b.jpg loading=eager srcset="b-2000.jpg 2000w" decoding="async">
+<iframe src="/embed" loading="lazy"></iframe><script>if (a < b) document.write("<img src=x>")</script>
+</body></html>`
+
+func (s *CompyTest) TestHTMLRewriter(c *C) {
+	p := proxy.New("", "")
+	p.AddTranscoder("text/html", &tc.Zip{
+		Transcoder: &tc.HTMLRewriter{
+			Transcoder:     &tc.Identity{},
+			LazyLoad:       true,
+			MaxSrcsetWidth: 1000,
+			DropPreloads:   true,
+		},
+		GzipCompressionLevel: *gzip,
+	})
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+		Body:       ioutil.NopCloser(strings.NewReader(rewriteInput)),
+	}
+	buf := proxy.NewResponseBuffer()
+	_, _, err := p.TranscodeResponse(buf, resp, http.Header{"Accept-Encoding": {"gzip"}})
+	c.Assert(err, IsNil)
+	c.Assert(buf.Header().Get("Content-Encoding"), Equals, "gzip")
+	gzr, err := gzipp.NewReader(buf)
+	c.Assert(err, IsNil)
+	body, err := ioutil.ReadAll(gzr)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, rewriteOutput)
+}
+
+func (s *CompyTest) TestHTMLRewriterKeepsEncoding(c *C) {
+	p := proxy.New("", "")
+	p.AddTranscoder("text/html", &tc.HTMLRewriter{Transcoder: &tc.Identity{}, LazyLoad: true})
+	// ISO-8859-1, with an invalid UTF-8 byte and an entity in the tag
+	input := "<p>caf\xe9</p><img src='caf\xe9.jpg' alt=\"\xe9t\xe9 &eacute;\" / >"
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/html; charset=iso-8859-1"}},
+		Body:       ioutil.NopCloser(strings.NewReader(input)),
+	}
+	buf := proxy.NewResponseBuffer()
+	_, _, err := p.TranscodeResponse(buf, resp, http.Header{})
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals,
+		"<p>caf\xe9</p><img src='caf\xe9.jpg' alt=\"\xe9t\xe9 &eacute;\" loading=\"lazy\" decoding=\"async\" / >")
+}
+
+const testFilters = `[Adblock Plus 2.0]
+! network filters
+||127.0.0.1^*/ads/$image
+/track.js$script,third-party
+@@/ads/allowed.
+||ads.example^
+/banner/*/img^
+|https://pixel.$~script
+/\/[0-9]{6}\.gif$/$domain=news.example|~sports.news.example
+||cdn.example/cookie-notice.js$important
+@@||cdn.example^$script
+||tracker.example^$csp=script-src 'none'
+@@||trusted.example^$document
+# hosts file
+0.0.0.0 adserver.example # comment
+127.0.0.1 localhost
+! element hiding
+example.com##.banner
+##.ad-slot
+##div#sponsor > a
+##:not(.content) > .promo, .other
+example.com#@#.ad-slot
+example.com##+js(noop)
+`
+
+func (s *CompyTest) TestBlocker(c *C) {
+	b := proxy.NewBlocker()
+	c.Assert(b.Load(strings.NewReader(testFilters)), IsNil)
+	c.Assert(b.Skipped, Equals, 3)
+
+	blocks := func(u, dest, referer string) bool {
+		r := httptest.NewRequest("GET", u, nil)
+		if dest != "" {
+			r.Header.Set("Sec-Fetch-Dest", dest)
+		}
+		if referer != "" {
+			r.Header.Set("Referer", referer)
+		}
+		return b.Blocks(r)
+	}
+	for _, t := range []struct {
+		url, dest, referer string
+		blocked            bool
+	}{
+		{"http://ads.example/x.js", "script", "", true},
+		{"http://sub.ads.example/x.js", "script", "", true},
+		{"http://badads.example/x.js", "script", "", false},
+		{"http://ads.example/", "document", "", false},
+		{"http://adserver.example/", "document", "", true},
+		{"http://site.example/banner/300x250/img/1.png", "image", "", true},
+		{"http://site.example/banner/img/1.png", "image", "", false},
+		{"http://site.example/lib/track.js", "script", "http://other.example/", true},
+		{"http://site.example/lib/track.js", "script", "http://www.site.example/", false},
+		{"http://site.example/lib/track.js", "image", "http://other.example/", false},
+		{"https://pixel.site.example/p", "image", "", true},
+		{"https://pixel.site.example/p.js", "script", "", false},
+		{"http://img.example/123456.gif", "image", "http://news.example/", true},
+		{"http://img.example/123456.gif", "image", "http://sports.news.example/", false},
+		{"http://img.example/123456.gif", "image", "http://blog.example/", false},
+		{"http://cdn.example/cookie-notice.js", "script", "", true},
+		{"http://ads.example/x.js", "script", "http://trusted.example/", false},
+		{"http://tracker.example/t.js", "script", "", false},
+		{"http://127.0.0.1:8080/ads/a.png", "", "", true},
+		{"http://127.0.0.1:8080/ads/a.png", "image", "", true},
+		{"http://127.0.0.1:8080/ads/allowed.png", "image", "", false},
+	} {
+		c.Check(blocks(t.url, t.dest, t.referer), Equals, t.blocked, Commentf("%v", t))
+	}
+
+	c.Assert(b.BlocksHost("adserver.example:443"), Equals, true)
+	c.Assert(b.BlocksHost("www.adserver.example:443"), Equals, true)
+	c.Assert(b.BlocksHost("ads.example:443"), Equals, false)
+
+	u, _ := url.Parse("http://www.example.com/")
+	h := b.ElementHiding(u)
+	c.Assert(h, NotNil)
+	c.Assert(h.Specific, DeepEquals, []string{".banner"})
+	c.Assert(h.Generic(".ad-slot"), IsNil)
+	c.Assert(h.Generic("#sponsor"), DeepEquals, []string{"div#sponsor > a"})
+	c.Assert(h.Generic(".promo"), IsNil)
+	u, _ = url.Parse("http://other.example/")
+	c.Assert(b.ElementHiding(u).Generic(".ad-slot"), DeepEquals, []string{".ad-slot"})
+}
+
+func (s *CompyTest) TestBlocking(c *C) {
+	get := func(path, dest string) *http.Response {
+		req, err := http.NewRequest("GET", s.origin.URL+path, nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Sec-Fetch-Dest", dest)
+		req.Header.Set("Referer", "http://other.example/")
+		resp, err := s.client.Do(req)
+		c.Assert(err, IsNil)
+		return resp
+	}
+	blocked := atomic.LoadUint64(&s.proxy.BlockedCount)
+	resp := get("/ads/banner.png", "image")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 200)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/gif")
+	img, err := gifp.Decode(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(img.Bounds().Dx(), Equals, 1)
+
+	resp = get("/js/track.js", "script")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 200)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "application/javascript")
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(body, HasLen, 0)
+	c.Assert(atomic.LoadUint64(&s.proxy.BlockedCount), Equals, blocked+2)
+	c.Assert(atomic.LoadUint64(&s.proxy.BlockedBytesEstimate) > 0, Equals, true)
+
+	// readable by pages, but not with credentials
+	req, err := http.NewRequest("GET", s.origin.URL+"/js/track.js", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Origin", "http://other.example")
+	resp, err = s.client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.Header.Get("Access-Control-Allow-Origin"), Equals, "*")
+	c.Assert(resp.Header.Get("Access-Control-Allow-Credentials"), Equals, "")
+
+	resp = get("/ads/banner.png", "script")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 404)
+	resp = get("/ads/allowed.png", "image")
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 404)
+}
+
+func (s *CompyTest) TestElementHiding(c *C) {
+	b := proxy.NewBlocker()
+	c.Assert(b.Load(strings.NewReader(testFilters)), IsNil)
+	p := proxy.New("", "")
+	p.AddTranscoder("text/html", &tc.HTMLRewriter{Transcoder: &tc.Identity{}, Blocker: b})
+	req := httptest.NewRequest("GET", "http://www.example.com/", nil)
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body: ioutil.NopCloser(strings.NewReader(
+			`<html><head><title>t</title></head><body><div id=sponsor><a class="ad-slot x">ad</a></div></body></html>`)),
+		Request: req,
+	}
+	buf := proxy.NewResponseBuffer()
+	_, _, err := p.TranscodeResponse(buf, resp, http.Header{})
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, `<html><head><title>t</title><style>.banner{display:none!important}</style></head>`+
+		`<body><div id=sponsor><a class="ad-slot x">ad</a></div></body></html>`+
+		`<style>div#sponsor > a{display:none!important}</style>`)
+}
+
+// flatPng is an uncompressed PNG of a single color, shrinking a lot when
+// transcoded.
+func flatPng() []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{200, 30, 30, 255}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	encoder := pngp.Encoder{CompressionLevel: pngp.NoCompression}
+	encoder.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func (s *CompyTest) TestDataURIs(c *C) {
+	p := proxy.New("", "")
+	p.AddTranscoder("image/png", &tc.Png{})
+	p.AddTranscoder("text/css", &tc.DataURIs{Transcoder: &tc.Identity{}, Images: p})
+	data := base64.StdEncoding.EncodeToString(flatPng())
+	svg := "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString([]byte("<svg/>"))
+	css := ".a{background:url(data:image/png;base64," + data + ")}.b{background:url('" + svg + "')}"
+	for _, accept := range []string{"image/webp", "image/png"} {
+		resp := &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": {"text/css"}},
+			Body:       ioutil.NopCloser(strings.NewReader(css)),
+		}
+		buf := proxy.NewResponseBuffer()
+		_, _, err := p.TranscodeResponse(buf, resp, http.Header{"Accept": {accept}})
+		c.Assert(err, IsNil)
+		c.Assert(buf.Header().Get("Vary"), Equals, "Accept")
+		out := buf.String()
+		c.Assert(strings.HasPrefix(out, ".a{background:url(data:"+accept+";base64,"), Equals, true, Commentf(out))
+		c.Assert(strings.HasSuffix(out, ")}.b{background:url('"+svg+"')}"), Equals, true)
+		c.Assert(len(out) < len(css)/2, Equals, true)
+
+		encoded := strings.TrimPrefix(out[:strings.Index(out, ")")], ".a{background:url(data:"+accept+";base64,")
+		img, err := base64.StdEncoding.DecodeString(encoded)
+		c.Assert(err, IsNil)
+		if accept == "image/webp" {
+			_, err = webp.Decode(bytes.NewReader(img))
+		} else {
+			_, err = pngp.Decode(bytes.NewReader(img))
+		}
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *CompyTest) TestImageInliner(c *C) {
+	inliner := &tc.ImageInliner{
+		MaxSize: 32 << 10,
+		Timeout: 5 * time.Second,
+	}
+	p := proxy.New("", "")
+	p.AddTranscoder("image/png", &tc.Png{})
+	p.AddTranscoder("text/html", &tc.HTMLRewriter{
+		Transcoder: &tc.Identity{},
+		Inline:     inliner,
+	})
+	inliner.Images = p
+	// the origin listens on 127.0.0.1, localhost is another site
+	crossSite := strings.Replace(s.origin.URL, "127.0.0.1", "localhost", 1) + "/flat.png?type=image/png"
+	rest := `<img src="../png?type=image/png" srcset="/png 2x">` +
+		`<img src="../missing.png"><img src="../html?type=text/html"><img src="` + crossSite + `">`
+	page := `<base href="/img/"><img src="../flat.png?type=image/png">` + rest
+	transcode := func() string {
+		resp := &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": {"text/html"}},
+			Body:       ioutil.NopCloser(strings.NewReader(page)),
+			Request:    httptest.NewRequest("GET", s.origin.URL+"/page.html", nil),
+		}
+		buf := proxy.NewResponseBuffer()
+		_, _, err := p.TranscodeResponse(buf, resp, http.Header{"Accept": {"image/webp"}})
+		c.Assert(err, IsNil)
+		return buf.String()
+	}
+
+	// by default only public addresses are fetched from
+	c.Assert(transcode(), Equals, page)
+
+	inliner.Client = &http.Client{}
+	out := transcode()
+	c.Assert(strings.HasPrefix(out, `<base href="/img/"><img src="data:image/webp;base64,`), Equals, true, Commentf(out))
+	c.Assert(strings.HasSuffix(out, `">`+rest), Equals, true, Commentf(out))
+}
+
+func minifyWith(c *C, m *tc.Minifier, rawurl, contentType, body string) string {
+	p := proxy.New("", "")
+	p.AddTranscoder(contentType, m)
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    httptest.NewRequest("GET", rawurl, nil),
+	}
+	buf := proxy.NewResponseBuffer()
+	_, _, err := p.TranscodeResponse(buf, resp, http.Header{})
+	c.Assert(err, IsNil)
+	return buf.String()
+}
+
+func (s *CompyTest) TestMinifyRules(c *C) {
+	rules, err := tc.ParseMinifyRules(strings.NewReader(`
+# broken by minification
+shop.example      *                           off
+*.news.example    text/javascript             aggressive
+*.news.example    text/html,text/css          on
+`))
+	c.Assert(err, IsNil)
+	m := tc.NewMinifier()
+	m.Default = tc.MinifyOff
+	m.Rules = rules
+	for _, t := range []struct {
+		host, contentType string
+		mode              tc.MinifyMode
+	}{
+		{"shop.example", "text/html", tc.MinifyOff},
+		{"news.example", "text/javascript", tc.MinifyAggressive},
+		{"www.News.example", "text/css", tc.MinifyConservative},
+		{"othernews.example", "text/css", tc.MinifyOff},
+		{"news.example", "application/javascript", tc.MinifyOff},
+	} {
+		c.Check(m.Mode(t.host, t.contentType), Equals, t.mode, Commentf("%v", t))
+	}
+
+	_, err = tc.ParseMinifyRules(strings.NewReader("example.com * sometimes"))
+	c.Assert(err, NotNil)
+
+	js := "function add(first, second) {\n  return first + second;\n}\n"
+	c.Assert(minifyWith(c, m, "http://shop.example/a.js", "text/javascript", js), Equals, js)
+	c.Assert(minifyWith(c, m, "http://news.example/a.js", "text/javascript", js), Equals,
+		"function add(e,t){return e+t}")
+}
+
+func (s *CompyTest) TestMinifyConservative(c *C) {
+	m := tc.NewMinifier()
+	html := `<html><head><title>t</title></head><body>
+<!--[if IE]><p>old</p><![endif]-->
+<p class="a">one</p>
+<pre>  keep
+    this</pre>
+<script>function add(first, second) { return first + second; }</script>
+</body></html>`
+	c.Assert(minifyWith(c, m, "http://example.com/", "text/html", html), Equals,
+		`<html><head><title>t</title></head><body><!--[if IE]><p>old</p><![endif]--><p class="a">one</p>`+
+			"<pre>  keep\n    this</pre><script>function add(first,second){return first+second}</script></body></html>")
+}
+
+func (s *CompyTest) TestMinifyFallback(c *C) {
+	m := tc.NewMinifier()
+	broken := "function (] { not javascript"
+	c.Assert(minifyWith(c, m, "http://example.com/a.js", "application/javascript", broken), Equals, broken)
+	c.Assert(minifyWith(c, m, "http://example.com/a.js", "application/x-javascript", "var a = 1 ;"), Equals, "var a=1")
+}
+
+func (s *CompyTest) TestMinifyTypes(c *C) {
+	m := tc.NewMinifier()
+	for _, t := range []struct{ contentType, body, minified string }{
+		{"application/json", "{ \"a\": [1, 2.50] }", `{"a":[1,2.50]}`},
+		{"application/ld+json", "{ \"@type\": \"Thing\" }", `{"@type":"Thing"}`},
+		{"application/xml", "<?xml version=\"1.0\"?>\n<a>  <!-- c -->\n  <b x = \"1\"></b>\n</a>", "<?xml version=\"1.0\"?><a>\n<b x=\"1\"/>\n</a>"},
+		{"application/atom+xml", "<feed>\n  <title>t</title>\n</feed>", "<feed>\n<title>t</title>\n</feed>"},
+		{"image/svg+xml", `<svg xmlns="http://www.w3.org/2000/svg"> <!-- c --> <rect width="10.000" height="10"/> </svg>`,
+			`<svg xmlns="http://www.w3.org/2000/svg"><rect width="10" height="10"/></svg>`},
+		{"application/xhtml+xml", "<html>\n<br/>\n</html>", "<html>\n<br/>\n</html>"},
+		{"application/json", "{ broken", "{ broken"},
+	} {
+		c.Check(minifyWith(c, m, "http://example.com/", t.contentType, t.body), Equals, t.minified, Commentf(t.contentType))
+	}
+}
+
+func transcodeSVG(c *C, svg string, headers http.Header) *proxy.ResponseBuffer {
+	images := proxy.New("", "")
+	images.AddTranscoder("image/png", &tc.Png{})
+	t := &tc.SVG{
+		Transcoder:    &tc.Identity{},
+		Minifier:      tc.NewMinifier(),
+		RasterizeSize: 1000,
+		Images:        images,
+	}
+	p := proxy.New("", "")
+	p.AddTranscoder("image/svg+xml", t)
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"image/svg+xml"}},
+		Body:       ioutil.NopCloser(strings.NewReader(svg)),
+	}
+	buf := proxy.NewResponseBuffer()
+	_, _, err := p.TranscodeResponse(buf, resp, headers)
+	c.Assert(err, IsNil)
+	return buf
+}
+
+func (s *CompyTest) TestSVGRasterize(c *C) {
+	var rects strings.Builder
+	for i := 0; i < 64; i++ {
+		fmt.Fprintf(&rects, `<rect x="%d" y="%d" width="1" height="1" fill="#%02x2040"/>`, i, (i*7)%64, i*4)
+	}
+	svg := func(size string) string {
+		return `<svg xmlns="http://www.w3.org/2000/svg" ` + size + ` viewBox="0 0 64 64">` + rects.String() + `</svg>`
+	}
+	webpAccept := http.Header{"Accept": {"image/webp"}}
+
+	buf := transcodeSVG(c, svg(`width="64" height="64"`), webpAccept)
+	c.Assert(buf.Header().Get("Content-Type"), Equals, "image/webp")
+	img, err := webp.Decode(buf)
+	c.Assert(err, IsNil)
+	c.Assert(img.Bounds().Dx(), Equals, 64)
+
+	buf = transcodeSVG(c, svg(`width="64" height="64"`), http.Header{"Accept": {"image/png"}})
+	c.Assert(buf.Header().Get("Content-Type"), Equals, "image/png")
+	_, err = pngp.Decode(buf)
+	c.Assert(err, IsNil)
+
+	// rendered at the intrinsic size rather than the viewBox size
+	for _, t := range []struct {
+		size          string
+		width, height int
+	}{
+		{`width="128" height="96px"`, 128, 96},
+		{`width="1in"`, 96, 96},
+	} {
+		buf = transcodeSVG(c, svg(t.size), webpAccept)
+		c.Assert(buf.Header().Get("Content-Type"), Equals, "image/webp", Commentf(t.size))
+		img, err = webp.Decode(buf)
+		c.Assert(err, IsNil)
+		c.Check(img.Bounds().Dx(), Equals, t.width, Commentf(t.size))
+		c.Check(img.Bounds().Dy(), Equals, t.height, Commentf(t.size))
+	}
+
+	// no intrinsic size, or displayed larger than it
+	for _, t := range []struct {
+		size  string
+		hints http.Header
+	}{
+		{``, nil},
+		{`width="100%" height="100%"`, nil},
+		{`width="64" height="64"`, http.Header{"Sec-Ch-Dpr": {"2"}}},
+		{`width="64" height="64"`, http.Header{"Dpr": {"1.5"}}},
+		{`width="64" height="64"`, http.Header{"Sec-Ch-Width": {"200"}}},
+	} {
+		headers := http.Header{"Accept": {"image/webp"}}
+		for name, values := range t.hints {
+			headers[name] = values
+		}
+		buf = transcodeSVG(c, svg(t.size), headers)
+		c.Check(buf.Header().Get("Content-Type"), Equals, "image/svg+xml", Commentf("%s %v", t.size, t.hints))
+	}
+	buf = transcodeSVG(c, svg(`width="64" height="64"`), http.Header{"Accept": {"image/webp"}, "Sec-Ch-Dpr": {"1"}})
+	c.Assert(buf.Header().Get("Content-Type"), Equals, "image/webp")
+	c.Assert(strings.Join(buf.Header()["Vary"], ","), Matches, ".*Sec-CH-DPR.*")
+
+	text := strings.Replace(svg(`width="64" height="64"`), "/>", "/>\n", -1)
+	text = strings.Replace(text, "</svg>", `<text x="0" y="10">compy</text></svg>`, 1)
+	buf = transcodeSVG(c, text, webpAccept)
+	c.Assert(buf.Header().Get("Content-Type"), Equals, "image/svg+xml")
+	c.Assert(buf.Len() < len(text), Equals, true)
+}
+
+func (s *CompyTest) getWebP(c *C, path string) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", s.origin.URL+path, nil)
+	c.Assert(err, IsNil)
+	req.Header.Add("Accept", "image/webp")
+
+	resp, err := s.client.Do(req)
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 200)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	return resp, body
+}
+
+func (s *CompyTest) TestSniffGeneric(c *C) {
+	resp, body := s.getWebP(c, "/png?type=application/octet-stream")
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/webp")
+	_, err := webp.Decode(bytes.NewReader(body))
+	c.Assert(err, IsNil)
+
+	resp, _ = s.getWebP(c, "/png?type=")
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/webp")
+}
+
+func (s *CompyTest) TestSniffKeepsDeclaredType(c *C) {
+	html := "<!DOCTYPE html><html><body>not an image</body></html>"
+	for _, t := range []struct {
+		path, contentType, body string
+	}{
+		// never relabelled as markup
+		{"/html?type=application/octet-stream", "application/octet-stream", html},
+		{"/html?type=", "", html},
+		// sniffed, but left as it is
+		{"/json?type=application/octet-stream", "application/octet-stream", `{"small":true}`},
+	} {
+		resp, err := s.client.Get(s.origin.URL + t.path)
+		c.Assert(err, IsNil)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(err, IsNil)
+		c.Check(resp.Header.Get("Content-Type"), Equals, t.contentType, Commentf(t.path))
+		c.Check(resp.Header.Get("Warning"), Equals, "", Commentf(t.path))
+		c.Check(string(body), Equals, t.body, Commentf(t.path))
+	}
+}
+
+func (s *CompyTest) TestSniffMislabelled(c *C) {
+	resp, _ := s.getWebP(c, "/png?type=image/jpeg")
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/webp")
+
+	resp, body := s.getWebP(c, "/html?type=image/png")
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/png")
+	c.Assert(string(body), Equals, "<!DOCTYPE html><html><body>not an image</body></html>")
+}
+
+func (s *CompyTest) TestSniffNosniff(c *C) {
+	resp, body := s.getWebP(c, "/png?type=application/octet-stream&nosniff=1")
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "application/octet-stream")
+	_, err := pngp.Decode(bytes.NewReader(body))
+	c.Assert(err, IsNil)
+
+	resp, body = s.getWebP(c, "/png?type=image/jpeg&nosniff=1")
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/jpeg")
+	_, err = pngp.Decode(bytes.NewReader(body))
+	c.Assert(err, IsNil)
+}
+
+type namedTranscoder string
+
+func (t namedTranscoder) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
+	_, err := w.Write([]byte(t))
+	return err
+}
+
+func transcodeWith(c *C, p *proxy.Proxy, contentType string) string {
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+	}
+	buf := proxy.NewResponseBuffer()
+	_, _, err := p.TranscodeResponse(buf, resp, http.Header{})
+	c.Assert(err, IsNil)
+	return buf.String()
+}
+
+func (s *CompyTest) TestTranscoderPatterns(c *C) {
+	p := proxy.New("", "")
+	p.AddTranscoder("image/*", namedTranscoder("image"))
+	p.AddTranscoder("image/png", namedTranscoder("png"))
+	p.AddTranscoder("+json", namedTranscoder("json"))
+	p.AddTranscoder("text/html; charset=utf-8", namedTranscoder("utf-8 html"))
+	p.AddTranscoder("text/html", namedTranscoder("html"))
+	c.Assert(p.AddTranscoderPriority("*/*", -1, namedTranscoder("any")), IsNil)
+	c.Assert(p.AddTranscoderPriority("image/gif", 0, namedTranscoder("gif")), IsNil)
+	c.Assert(p.AddTranscoderPriority("image/*", 1, namedTranscoder("image")), IsNil)
+	c.Assert(p.AddTranscoderPriority("image/svg+xml; x=", 0, nil), NotNil)
+
+	c.Assert(transcodeWith(c, p, "image/png"), Equals, "image")
+	c.Assert(transcodeWith(c, p, "image/jpeg"), Equals, "image")
+	c.Assert(transcodeWith(c, p, "application/ld+json"), Equals, "json")
+	c.Assert(transcodeWith(c, p, "text/html; charset=UTF-8"), Equals, "utf-8 html")
+	c.Assert(transcodeWith(c, p, "text/html; charset=iso-8859-1"), Equals, "html")
+	c.Assert(transcodeWith(c, p, "text/plain"), Equals, "any")
+
+	p = proxy.New("", "")
+	p.AddTranscoder("text/*", namedTranscoder("text"))
+	c.Assert(transcodeWith(c, p, "application/json"), Equals, "")
+	p.SetFallbackTranscoder(namedTranscoder("fallback"))
+	c.Assert(transcodeWith(c, p, "application/json"), Equals, "fallback")
+	c.Assert(p.Transcoders(), HasLen, 2)
+}
+
+func (s *CompyTest) TestAdminTranscoders(c *C) {
+	resp, err := s.client.Get("http://localhost" + *host + "/transcoders")
+	c.Assert(err, IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, 200)
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Matches, "(?s).*<td>image/png</td><td>0</td><td>\\*transcoder.Png</td>.*")
+}
+
+func (s *CompyTest) TestCompressMinSize(c *C) {
+	get := func(path string) string {
+		req, err := http.NewRequest("GET", s.origin.URL+path, nil)
+		c.Assert(err, IsNil)
+		req.Header.Add("Accept-Encoding", "gzip")
+		resp, err := s.client.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, 200)
+		return resp.Header.Get("Content-Encoding")
+	}
+	c.Assert(get("/big.json?type=application/vnd.api%2Bjson"), Equals, "gzip")
+	c.Assert(get("/json?type=application/vnd.api%2Bjson"), Equals, "")
+}
+
+// sfntTables returns the tables of a TrueType font.
+func sfntTables(c *C, data []byte) map[string][]byte {
+	tables := make(map[string][]byte)
+	for i := 0; i < int(binary.BigEndian.Uint16(data[4:])); i++ {
+		record := data[12+16*i:]
+		offset, length := binary.BigEndian.Uint32(record[8:]), binary.BigEndian.Uint32(record[12:])
+		tables[string(record[:4])] = data[offset : offset+length]
+	}
+	return tables
+}
+
+var woff2KnownTags = []string{
+	"cmap", "head", "hhea", "hmtx", "maxp", "name", "OS/2", "post",
+	"cvt ", "fpgm", "glyf", "loca", "prep", "CFF ", "VORG", "EBDT",
+	"EBLC", "gasp", "hdmx", "kern", "LTSH", "PCLT", "VDMX", "vhea",
+	"vmtx", "BASE", "GDEF", "GPOS", "GSUB", "EBSC", "JSTF", "MATH",
+}
+
+// woff2Tables returns the tables of a WOFF2 font with null transforms.
+func woff2Tables(c *C, data []byte) map[string][]byte {
+	c.Assert(string(data[:4]), Equals, "wOF2")
+	c.Assert(int(binary.BigEndian.Uint32(data[8:])), Equals, len(data))
+	var tags []string
+	var lengths []int
+	p := 48
+	for i := 0; i < int(binary.BigEndian.Uint16(data[12:])); i++ {
+		flags := data[p]
+		p++
+		tag := string(data[p : p+4])
+		if flags&63 != 63 {
+			tag = woff2KnownTags[flags&63]
+		} else {
+			p += 4
+		}
+		if tag == "glyf" || tag == "loca" {
+			c.Assert(flags>>6, Equals, byte(3))
+		}
+		length := 0
+		for data[p]&0x80 != 0 {
+			length = length<<7 | int(data[p]&0x7f)
+			p++
+		}
+		length = length<<7 | int(data[p])
+		p++
+		tags, lengths = append(tags, tag), append(lengths, length)
+	}
+	stream, err := ioutil.ReadAll(brotlip.NewReader(bytes.NewReader(data[p : p+int(binary.BigEndian.Uint32(data[20:]))])))
+	c.Assert(err, IsNil)
+	tables := make(map[string][]byte)
+	for i, tag := range tags {
+		tables[tag], stream = stream[:lengths[i]], stream[lengths[i]:]
+	}
+	c.Assert(stream, HasLen, 0)
+	return tables
+}
+
+func (s *CompyTest) TestFontWOFF2(c *C) {
+	font := &tc.Font{Transcoder: &tc.Identity{}, WOFF2: true}
+	buf := transcodeImage(c, font, "font/ttf", goregular.TTF, "font/woff2")
+	c.Assert(buf.Header().Get("Content-Type"), Equals, "font/woff2")
+	c.Assert(buf.Header()["Vary"], DeepEquals, []string{"Accept", "User-Agent"})
+	c.Assert(buf.Len() < len(goregular.TTF)/2, Equals, true)
+	c.Assert(woff2Tables(c, buf.Bytes()), DeepEquals, sfntTables(c, goregular.TTF))
+
+	buf = transcodeImage(c, font, "font/ttf", goregular.TTF, "*/*")
+	c.Assert(buf.Header().Get("Content-Type"), Equals, "font/ttf")
+	c.Assert(buf.Bytes(), DeepEquals, goregular.TTF)
+}
+
+func (s *CompyTest) TestSupportsWOFF2(c *C) {
+	for _, t := range []struct {
+		accept, ua string
+		supported  bool
+	}{
+		{"application/font-woff2;q=1.0,application/font-woff;q=0.9,*/*;q=0.8", "", true},
+		{"font/woff2;q=0", "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", false},
+		{"*/*", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", true},
+		{"*/*", "Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/42.0.2311.135 Safari/537.36 Edge/12.10136", false},
+		{"*/*", "Mozilla/5.0 (Linux; U; Android 4.4.2) AppleWebKit/534.30 (KHTML, like Gecko) Version/4.0 Chrome/30.0.0.0 Mobile Safari/534.30", false},
+		{"*/*", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15", true},
+		{"*/*", "Mozilla/5.0 (iPhone; CPU iPhone OS 9_3 like Mac OS X) AppleWebKit/601.1.46 (KHTML, like Gecko) CriOS/50.0 Mobile/13E233 Safari/601.1.46", false},
+		{"*/*", "Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Mobile/15E148 Safari/604.1", true},
+		{"*/*", "Mozilla/5.0 (compatible; MSIE 10.0; Windows NT 6.1; Trident/6.0)", false},
+	} {
+		c.Check(tc.SupportsWOFF2(http.Header{"Accept": {t.accept}, "User-Agent": {t.ua}}), Equals, t.supported, Commentf(t.ua))
+	}
+}
+
+func (s *CompyTest) TestFontSubset(c *C) {
+	font := &tc.Font{Transcoder: &tc.Identity{}, LatinHosts: []string{"*"}}
+	buf := transcodeImage(c, font, "font/ttf", goregular.TTF, "*/*")
+	c.Assert(buf.Header().Get("Content-Type"), Equals, "font/ttf")
+	c.Assert(buf.Len() < len(goregular.TTF), Equals, true)
+
+	original, err := sfnt.Parse(goregular.TTF)
+	c.Assert(err, IsNil)
+	subset, err := sfnt.Parse(buf.Bytes())
+	c.Assert(err, IsNil)
+	c.Assert(subset.NumGlyphs(), Equals, original.NumGlyphs())
+	var b sfnt.Buffer
+	for _, r := range "aÄŁ€ﬁ" {
+		want, err := original.GlyphIndex(&b, r)
+		c.Assert(err, IsNil)
+		got, err := subset.GlyphIndex(&b, r)
+		c.Assert(err, IsNil)
+		c.Assert(got, Equals, want, Commentf("%c", r))
+		_, err = subset.LoadGlyph(&b, got, fixed.I(12), nil)
+		c.Assert(err, IsNil)
+	}
+	for _, r := range "ЖΩ" {
+		want, err := original.GlyphIndex(&b, r)
+		c.Assert(err, IsNil)
+		c.Assert(want, Not(Equals), sfnt.GlyphIndex(0))
+		got, err := subset.GlyphIndex(&b, r)
+		c.Assert(err, IsNil)
+		c.Assert(got, Equals, sfnt.GlyphIndex(0), Commentf("%c", r))
+	}
+
+	// the host doesn't match
+	font.LatinHosts = []string{"*.example.com"}
+	buf = transcodeImage(c, font, "font/ttf", goregular.TTF, "*/*")
+	c.Assert(buf.Bytes(), DeepEquals, goregular.TTF)
+}
+
+func (s *CompyTest) TestNoTransform(c *C) {
+	get := func(path string, header http.Header) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", s.origin.URL+path, nil)
+		c.Assert(err, IsNil)
+		req.Header = header
+		req.Header.Set("Accept", "image/webp")
+		resp, err := s.client.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp, body
+	}
+	resp, _ := get("/png?type=image/png", http.Header{})
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/webp")
+	c.Assert(resp.Header.Get("Warning"), Equals, `214 compy "Transformation applied"`)
+	c.Assert(resp.Header.Get("Via"), Equals, "1.1 compy")
+
+	for _, t := range []struct {
+		path, contentType string
+		header            http.Header
+	}{
+		{"/png?type=image/png&cc=public,+no-transform", "image/png", http.Header{}},
+		{"/png?type=image/png", "image/png", http.Header{"Cache-Control": {"No-Transform"}}},
+		// not sniffed either
+		{"/png?type=application/octet-stream&cc=no-transform", "application/octet-stream", http.Header{}},
+	} {
+		resp, body := get(t.path, t.header)
+		c.Check(resp.Header.Get("Content-Type"), Equals, t.contentType, Commentf(t.path))
+		c.Check(resp.Header.Get("Warning"), Equals, "", Commentf(t.path))
+		_, err := pngp.Decode(bytes.NewReader(body))
+		c.Check(err, IsNil, Commentf(t.path))
+	}
+
+	// passed through unchanged, if sniffed and captured
+	resp, _ = get("/json?type=application/ld%2Bjson", http.Header{})
+	c.Assert(resp.Header.Get("Warning"), Equals, "")
+}
+
+func (s *CompyTest) TestIntegrity(c *C) {
+	integrity := tc.NewIntegrityURLs()
+	m := tc.NewMinifier()
+	m.Integrity = integrity
+	p := proxy.New("", "")
+	p.AddTranscoder("text/html", &tc.HTMLRewriter{Transcoder: &tc.Identity{}, Integrity: integrity})
+	page := `<script src="/checked.js" integrity="sha384-x"></script><script src="/other.js"></script>` +
+		`<link rel="stylesheet" href="https://cdn.example/s.css#v1" integrity="sha384-y">`
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       ioutil.NopCloser(strings.NewReader(page)),
+		Request:    httptest.NewRequest("GET", "http://example.com/page/", nil),
+	}
+	buf := proxy.NewResponseBuffer()
+	_, _, err := p.TranscodeResponse(buf, resp, http.Header{})
+	c.Assert(err, IsNil)
+	c.Assert(buf.String(), Equals, page)
+	c.Assert(integrity.Contains("https://cdn.example/s.css"), Equals, true)
+
+	js := "var a = 1 ;"
+	c.Assert(minifyWith(c, m, "http://example.com/checked.js", "text/javascript", js), Equals, js)
+	c.Assert(minifyWith(c, m, "http://example.com/other.js", "text/javascript", js), Equals, "var a=1")
+}
+
+func (s *CompyTest) TestRange(c *C) {
+	get := func(path string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", s.origin.URL+path, nil)
+		c.Assert(err, IsNil)
+		req.Header.Set("Accept", "image/webp")
+		req.Header.Set("Range", "bytes=0-99")
+		resp, err := s.client.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp, body
+	}
+	resp, body := get("/png?type=image/png&ranges=1")
+	c.Assert(resp.StatusCode, Equals, 200)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/webp")
+	c.Assert(resp.Header.Get("Content-Range"), Equals, "")
+	c.Assert(resp.Header.Get("Accept-Ranges"), Equals, "none")
+	_, err := webp.Decode(bytes.NewReader(body))
+	c.Assert(err, IsNil)
+
+	// not transcoded, nor sniffed
+	resp, body = get("/png?type=application/octet-stream&ranges=1")
+	c.Assert(resp.StatusCode, Equals, 206)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "application/octet-stream")
+	c.Assert(resp.Header.Get("Content-Range"), Matches, "bytes 0-99/.*")
+	c.Assert(resp.Header.Get("Accept-Ranges"), Equals, "bytes")
+	c.Assert(body, HasLen, 100)
+
+	resp, body = get("/png?type=image/png&ranges=1&cc=no-transform")
+	c.Assert(resp.StatusCode, Equals, 206)
+	c.Assert(body, HasLen, 100)
+}
+
+func (s *CompyTest) TestETag(c *C) {
+	do := func(method, path string, header http.Header) *http.Response {
+		req, err := http.NewRequest(method, s.origin.URL+path, nil)
+		c.Assert(err, IsNil)
+		req.Header = header
+		if req.Header.Get("Accept") == "" {
+			req.Header.Set("Accept", "image/webp")
+		}
+		resp, err := s.client.Do(req)
+		c.Assert(err, IsNil)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	resp := do("GET", `/png?type=image/png&etag="v1"`, http.Header{})
+	c.Assert(resp.StatusCode, Equals, 200)
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/webp")
+	variant := resp.Header.Get("ETag")
+	c.Assert(variant, Matches, `W/"v1-compy-[0-9a-f]{16}"`)
+	c.Assert(resp.Header.Get("Content-MD5"), Equals, "")
+
+	// another variant
+	resp = do("GET", `/png?type=image/png&etag=W/"v1"`, http.Header{"Accept": {"image/png"}})
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/png")
+	c.Assert(resp.Header.Get("ETag"), Matches, `W/"v1-compy-[0-9a-f]{16}"`)
+	c.Assert(resp.Header.Get("ETag"), Not(Equals), variant)
+
+	resp = do("GET", `/png?type=image/png&etag="v1"`, http.Header{"If-None-Match": {`"other", ` + variant}})
+	c.Assert(resp.StatusCode, Equals, 304)
+	c.Assert(resp.Header.Get("ETag"), Equals, variant)
+	c.Assert(resp.Header.Get("Warning"), Equals, "")
+
+	// the variant cached isn't the one the request gets any more
+	for _, h := range []http.Header{
+		{proxy.QualityHeader: {"20"}},
+		{proxy.PlaceholderHeader: {"on"}},
+		{"Accept": {"image/png"}},
+	} {
+		h.Set("If-None-Match", variant)
+		h.Set("If-Modified-Since", time.Now().UTC().Format(http.TimeFormat))
+		resp = do("GET", `/png?type=image/png&etag="v1"`, h)
+		c.Assert(resp.StatusCode, Equals, 200, Commentf("%v", h))
+		c.Assert(resp.Header.Get("ETag"), Not(Equals), variant)
+	}
+
+	resp = do("GET", `/png?type=image/png&etag="v2"`, http.Header{"If-None-Match": {variant}})
+	c.Assert(resp.StatusCode, Equals, 200)
+	c.Assert(resp.Header.Get("ETag"), Matches, `W/"v2-compy-[0-9a-f]{16}"`)
+
+	resp = do("HEAD", `/png?type=image/png&etag="v1"`, http.Header{})
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "image/png")
+	c.Assert(resp.Header.Get("ETag"), Equals, `"v1"`)
+
+	// passed through
+	resp = do("GET", `/png?type=application/x-foo&nosniff=1&etag="v1"`, http.Header{})
+	c.Assert(resp.Header.Get("ETag"), Equals, `"v1"`)
+	c.Assert(resp.Header.Get("Content-MD5"), Not(Equals), "")
+	resp = do("GET", `/png?type=application/x-foo&nosniff=1&etag="v1"`, http.Header{"If-None-Match": {`"v1"`}})
+	c.Assert(resp.StatusCode, Equals, 304)
+
+	// variants of the same type and encoding
+	p := proxy.New("", "")
+	p.AddTranscoder("image/jpeg", tc.NewJpeg(50))
+	jpegETag := func(headers http.Header) string {
+		resp := &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": {"image/jpeg"}, "Etag": {`"v1"`}},
+			Body:       ioutil.NopCloser(bytes.NewReader(photoJpeg())),
+		}
+		buf := proxy.NewResponseBuffer()
+		_, _, err := p.TranscodeResponse(buf, resp, headers)
+		c.Assert(err, IsNil)
+		c.Assert(buf.Header().Get("Content-Type"), Equals, "image/jpeg")
+		return buf.Header().Get("ETag")
+	}
+	variant = jpegETag(http.Header{})
+	c.Assert(variant, Matches, `W/"v1-compy-[0-9a-f]{16}"`)
+	c.Assert(jpegETag(http.Header{}), Equals, variant)
+	c.Assert(jpegETag(http.Header{proxy.QualityHeader: {"20"}}), Not(Equals), variant)
+	p.SetTranscoderSettings("jpeg=30")
+	c.Assert(jpegETag(http.Header{}), Not(Equals), variant)
+}
+
+func (s *CompyTest) TestCoalescing(c *C) {
+	var hits int32
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		started <- struct{}{}
+		<-release
+		w.Header().Set("Content-Type", "image/png")
+		if cc := r.URL.Query().Get("cc"); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		w.Write(flatPng())
+	}))
+	defer origin.Close()
+
+	// fetchAll makes n concurrent requests through a new proxy capturing
+	// them, adding header(i) to the headers of request i if set
+	fetchAll := func(timeout time.Duration, path string, n int, header func(i int) http.Header) ([][]byte, *proxy.Proxy, []proxy.HAREntry) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, IsNil)
+		p := proxy.New(ln.Addr().String(), "")
+		p.AddTranscoder("image/png", &tc.Png{})
+		p.EnableCoalescing(timeout)
+		harDir := c.MkDir()
+		p.EnableCapture(harDir, true)
+		server := httptest.NewUnstartedServer(p)
+		server.Listener = ln
+		server.Start()
+		defer server.Close()
+		capture := func(action string) {
+			resp, err := http.PostForm(server.URL+"/capture", url.Values{"scope": {"global"}, "action": {action}})
+			c.Assert(err, IsNil)
+			resp.Body.Close()
+		}
+		proxyURL, _ := url.Parse(server.URL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+		capture("start")
+		atomic.StoreInt32(&hits, 0)
+		bodies := make([][]byte, n)
+		done := make(chan struct{})
+		for i := 0; i < n; i++ {
+			go func(i int) {
+				defer func() { done <- struct{}{} }()
+				req, _ := http.NewRequest("GET", origin.URL+path, nil)
+				req.Header.Set("Accept", "image/webp")
+				if header != nil {
+					for name, values := range header(i) {
+						req.Header[name] = values
+					}
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					return
+				}
+				defer resp.Body.Close()
+				if resp.Header.Get("Content-Type") == "image/webp" {
+					bodies[i], _ = ioutil.ReadAll(resp.Body)
+				}
+			}(i)
+		}
+		<-started
+		// let the others join or time out
+		time.Sleep(200 * time.Millisecond)
+		close(release)
+		for i := 0; i < n; i++ {
+			<-done
+		}
+		for len(started) > 0 {
+			<-started
+		}
+		release = make(chan struct{})
+		capture("stop")
+		files, err := filepath.Glob(filepath.Join(harDir, "*.har"))
+		c.Assert(err, IsNil)
+		c.Assert(files, HasLen, 1)
+		har, err := proxy.ReadHAR(files[0])
+		c.Assert(err, IsNil)
+		return bodies, p, har.Log.Entries
+	}
+
+	bodies, p, entries := fetchAll(5*time.Second, "/shared.png", 5, nil)
+	c.Assert(atomic.LoadInt32(&hits), Equals, int32(1))
+	for _, body := range bodies {
+		c.Assert(body, DeepEquals, bodies[0])
+		_, err := webp.Decode(bytes.NewReader(body))
+		c.Assert(err, IsNil)
+	}
+	// the shared responses are counted and captured too
+	c.Assert(atomic.LoadUint64(&p.ReadCount), Equals, uint64(5*len(flatPng())))
+	c.Assert(atomic.LoadUint64(&p.WriteCount), Equals, uint64(5*len(bodies[0])))
+	c.Assert(entries, HasLen, 5)
+	coalesced := 0
+	for _, e := range entries {
+		c.Assert(e.Response.Status, Equals, 200)
+		c.Assert(e.Response.Content.MimeType, Equals, "image/webp")
+		if e.Coalesced {
+			coalesced++
+			c.Assert(e.Response.Original, IsNil)
+		}
+	}
+	c.Assert(coalesced, Equals, 4)
+
+	fetchAll(5*time.Second, "/private.png?cc=private", 3, nil)
+	c.Assert(atomic.LoadInt32(&hits), Equals, int32(3))
+
+	// nor are responses to authenticated requests shared
+	fetchAll(5*time.Second, "/auth.png", 2, func(int) http.Header {
+		return http.Header{"Authorization": {"Basic dTpw"}}
+	})
+	c.Assert(atomic.LoadInt32(&hits), Equals, int32(2))
+
+	// headers the transcoders read select different responses
+	for _, name := range []string{proxy.QualityHeader, "Sec-CH-DPR"} {
+		fetchAll(5*time.Second, "/variant.png", 2, func(i int) http.Header {
+			return http.Header{name: {fmt.Sprint(20 + i)}}
+		})
+		c.Assert(atomic.LoadInt32(&hits), Equals, int32(2), Commentf(name))
+	}
+
+	// a stuck origin doesn't hold the others up
+	bodies, _, _ = fetchAll(50*time.Millisecond, "/slow.png", 3, nil)
+	c.Assert(atomic.LoadInt32(&hits), Equals, int32(3))
+	for _, body := range bodies {
+		c.Assert(body, Not(HasLen), 0)
+	}
+}
+
+func (s *CompyTest) TestCoalescingSlowLeader(c *C) {
+	// more than the socket buffers usually take before the leader's
+	// response blocks, but less than maxCoalescedBody
+	body := make([]byte, 7<<20)
+	rand.New(rand.NewSource(1)).Read(body)
+	var hits int32
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		started <- struct{}{}
+		<-release
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write(body)
+	}))
+	defer origin.Close()
+	p := proxy.New("", "")
+	p.EnableCoalescing(2 * time.Second)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	// the leader doesn't read its response until the follower has it
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s/big HTTP/1.1\r\nHost: %s\r\nUser-Agent: compy-test\r\n\r\n", origin.URL, origin.Listener.Addr())
+	<-started
+
+	followed := make(chan []byte)
+	go func() {
+		proxyURL, _ := url.Parse(server.URL)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableCompression: true}}
+		req, _ := http.NewRequest("GET", origin.URL+"/big", nil)
+		req.Header.Set("User-Agent", "compy-test")
+		resp, err := client.Do(req)
+		if err != nil {
+			followed <- nil
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		followed <- b
+	}()
+	// let the follower join
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	select {
+	case b := <-followed:
+		c.Assert(bytes.Equal(b, body), Equals, true)
+	case <-time.After(10 * time.Second):
+		c.Fatal("follower not served")
+	}
+	c.Assert(atomic.LoadInt32(&hits), Equals, int32(1))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	c.Assert(err, IsNil)
+	b, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Equal(b, body), Equals, true)
+}
@@ -1,18 +1,30 @@
 module github.com/barnacs/compy
 
-go 1.16
+go 1.22.2
 
 require (
+	github.com/HugoSmits86/nativewebp v0.9.3
 	github.com/ahmetb/go-httpbin v0.0.0-20200921172446-862fbad56b77
-	github.com/andybalholm/brotli v1.0.4 // indirect
+	github.com/andybalholm/brotli v1.0.4
 	github.com/chai2010/webp v1.1.1
-	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/klauspost/compress v1.15.9
 	github.com/miolini/datacounter v1.0.3
 	github.com/pixiv/go-libjpeg v0.0.0-20190822045933-3da21a74767d
-	github.com/pkg/errors v0.9.1 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c
+	github.com/srwiley/rasterx v0.0.0-20220730225603-2ab79fcdd4ef
 	github.com/tdewolff/minify/v2 v2.10.0
-	golang.org/x/net v0.0.0-20220225172249-27dd8689420f // indirect
+	github.com/tdewolff/parse/v2 v2.5.27
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.25.0
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c
 	gopkg.in/kothar/brotli-go.v0 v0.0.0-20170728081549-771231d473d6
 )
+
+require (
+	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/kr/pretty v0.2.1 // indirect
+	github.com/kr/text v0.1.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/stretchr/testify v1.7.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+)
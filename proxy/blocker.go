@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Blocker blocks requests matching Adblock Plus (EasyList) style network
+// filters or hosts file entries, and collects the element hiding rules of
+// the same lists for the HTML rewriter. Filters using options compy can't
+// honour, e.g. $csp or $redirect, are skipped, as are procedural and
+// scriptlet element hiding rules.
+type Blocker struct {
+	block   filterSet
+	allow   filterSet
+	hiding  hidingRules
+	Filters int
+	Skipped int
+}
+
+func NewBlocker() *Blocker {
+	return &Blocker{
+		block:  newFilterSet(),
+		allow:  newFilterSet(),
+		hiding: newHidingRules(),
+	}
+}
+
+// LoadFile adds the filters of a filter list or hosts file, see Load.
+func (b *Blocker) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := b.Load(f); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// Load adds the filters read from r. Filter lists and hosts files are told
+// apart line by line, so the two may be mixed.
+func (b *Blocker) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		b.addLine(strings.TrimSpace(scanner.Text()))
+	}
+	return scanner.Err()
+}
+
+func (b *Blocker) addLine(line string) {
+	switch {
+	case line == "", line[0] == '!', line[0] == '[':
+		return
+	case strings.HasPrefix(line, "##"), strings.HasPrefix(line, "#@#"):
+	case line[0] == '#':
+		return
+	}
+	if i := strings.IndexByte(line, '#'); i >= 0 && isHidingRule(line, i) {
+		if b.hiding.add(line[:i], line[i:]) {
+			b.Filters++
+		} else {
+			b.Skipped++
+		}
+		return
+	}
+	if fields := strings.Fields(line); net.ParseIP(fields[0]) != nil {
+		b.addHosts(fields[1:])
+		return
+	}
+	set := &b.block
+	if strings.HasPrefix(line, "@@") {
+		set = &b.allow
+		line = line[2:]
+	}
+	f, err := parseFilter(line)
+	if err != nil {
+		b.Skipped++
+		return
+	}
+	set.add(f)
+	b.Filters++
+}
+
+// addHosts blocks the hosts of a hosts file line. Unlike filters, these
+// cover every request to the host, including pages and HTTPS connections
+// compy can't look into.
+func (b *Blocker) addHosts(hosts []string) {
+	for _, host := range hosts {
+		if host[0] == '#' {
+			return
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if !strings.Contains(host, ".") || net.ParseIP(host) != nil {
+			// localhost, broadcasthost and the like
+			continue
+		}
+		b.block.add(&filter{
+			pattern:    host + "^",
+			hostAnchor: true,
+			types:      allTypes,
+		})
+		b.Filters++
+	}
+}
+
+// Blocks tells whether r is blocked.
+func (b *Blocker) Blocks(r *http.Request) bool {
+	_, blocked := b.match(r)
+	return blocked
+}
+
+func (b *Blocker) match(r *http.Request) (resourceType, bool) {
+	if b == nil || r.Method == "CONNECT" {
+		return 0, false
+	}
+	q := newBlockRequest(r)
+	f := b.block.match(q)
+	if f == nil {
+		return q.typ, false
+	}
+	if f.important {
+		return q.typ, true
+	}
+	if b.allow.match(q) != nil || b.pageAllowed(q.page, typeDocument) {
+		return q.typ, false
+	}
+	return q.typ, true
+}
+
+// BlocksHost tells whether all connections to host are blocked, as by a
+// hosts file.
+func (b *Blocker) BlocksHost(host string) bool {
+	if b == nil {
+		return false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	blocked := false
+	for _, domain := range parentDomains(host) {
+		if len(b.allow.domains[domain]) > 0 {
+			return false
+		}
+		for _, f := range b.block.domains[domain] {
+			blocked = blocked || f.types == allTypes && f.pattern == domain+"^" && f.isPlain()
+		}
+	}
+	return blocked
+}
+
+// pageAllowed tells whether an exception with the given type, e.g.
+// $document or $elemhide, covers the page at u.
+func (b *Blocker) pageAllowed(u *url.URL, typ resourceType) bool {
+	if u == nil {
+		return false
+	}
+	return b.allow.match(newPageRequest(u, typ)) != nil
+}
+
+// ElementHiding returns the element hiding rules for the page at u, nil if
+// there are none.
+func (b *Blocker) ElementHiding(u *url.URL) *ElementHiding {
+	if b == nil || u == nil || b.pageAllowed(u, typeElemHide) {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	h := &ElementHiding{
+		rules: &b.hiding,
+		host:  host,
+	}
+	if !b.pageAllowed(u, typeGenericHide) {
+		h.generic = b.hiding.generic
+	}
+	for _, domain := range parentDomains(host) {
+		for _, rule := range b.hiding.specific[domain] {
+			if rule.appliesTo(host) && !b.hiding.excepted(rule.selector, host) {
+				h.Specific = append(h.Specific, rule.selector)
+			}
+		}
+	}
+	if len(h.Specific) == 0 && h.generic == nil {
+		return nil
+	}
+	return h
+}
+
+// ElementHiding holds the selectors of elements to hide on a page: those
+// specific to its domain, and generic ones by the class or id they need.
+type ElementHiding struct {
+	Specific []string
+	generic  map[string][]hidingRule
+	rules    *hidingRules
+	host     string
+}
+
+// Generic returns the generic selectors needing an element with a class
+// (".name") or id ("#name").
+func (h *ElementHiding) Generic(key string) []string {
+	var selectors []string
+	for _, rule := range h.generic[key] {
+		if rule.appliesTo(h.host) && !h.rules.excepted(rule.selector, h.host) {
+			selectors = append(selectors, rule.selector)
+		}
+	}
+	return selectors
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// filter is a network filter, e.g. "||ads.example.com^$script,third-party".
+type filter struct {
+	// pattern is lower case unless matchCase, with * wildcards and ^
+	// separators
+	pattern    string
+	re         *regexp.Regexp
+	hostAnchor bool
+	start      bool
+	end        bool
+	matchCase  bool
+	important  bool
+	types      resourceType
+	// thirdParty is 1 for third party requests only, -1 for first party
+	// requests only
+	thirdParty int
+	include    []string
+	exclude    []string
+}
+
+func parseFilter(line string) (*filter, error) {
+	f := &filter{types: defaultTypes}
+	isRegexp := len(line) > 2 && line[0] == '/'
+	if i := strings.LastIndexByte(line, '$'); i >= 0 && (!isRegexp || i > strings.LastIndexByte(line, '/')) {
+		if err := f.parseOptions(line[i+1:]); err != nil {
+			return nil, err
+		}
+		line = line[:i]
+	}
+	if f.types == 0 {
+		return nil, fmt.Errorf("no supported types")
+	}
+	if len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/' {
+		expr := line[1 : len(line)-1]
+		if !f.matchCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		f.re = re
+		return f, nil
+	}
+
+	switch {
+	case strings.HasPrefix(line, "||"):
+		f.hostAnchor = true
+		line = line[2:]
+	case strings.HasPrefix(line, "|"):
+		f.start = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "|") {
+		f.end = true
+		line = line[:len(line)-1]
+	}
+	for strings.Contains(line, "**") {
+		line = strings.ReplaceAll(line, "**", "*")
+	}
+	if strings.HasPrefix(line, "*") && !f.hostAnchor {
+		f.start = false
+		line = strings.TrimLeft(line, "*")
+	}
+	if strings.HasSuffix(line, "*") {
+		f.end = false
+		line = strings.TrimRight(line, "*")
+	}
+	if !f.matchCase {
+		line = strings.ToLower(line)
+	}
+	f.pattern = line
+	return f, nil
+}
+
+func (f *filter) parseOptions(options string) error {
+	var types, notTypes resourceType
+	popup := false
+	for _, option := range strings.Split(options, ",") {
+		option = strings.TrimSpace(option)
+		negated := strings.HasPrefix(option, "~")
+		name, value, _ := strings.Cut(strings.TrimPrefix(option, "~"), "=")
+		name = strings.ToLower(name)
+		if t, ok := typeOptions[name]; ok {
+			switch {
+			case negated:
+				notTypes |= t
+			case t == 0:
+				popup = true
+			default:
+				types |= t
+			}
+			continue
+		}
+		switch name {
+		case "third-party", "3p":
+			f.thirdParty = 1
+		case "first-party", "1p":
+			f.thirdParty = -1
+		case "domain", "from":
+			for _, domain := range strings.Split(strings.ToLower(value), "|") {
+				if strings.HasPrefix(domain, "~") {
+					f.exclude = append(f.exclude, domain[1:])
+				} else if domain != "" {
+					f.include = append(f.include, domain)
+				}
+			}
+			continue
+		case "match-case":
+			f.matchCase = true
+			continue
+		case "important":
+			f.important = true
+			continue
+		case "all":
+			types |= allTypes
+			continue
+		case "collapse":
+			continue
+		default:
+			return fmt.Errorf("unsupported option %q", option)
+		}
+		if negated {
+			f.thirdParty = -f.thirdParty
+		}
+	}
+	switch {
+	case types != 0:
+		f.types = types &^ notTypes
+	case popup:
+		// popups aren't requests compy sees
+		f.types = 0
+	default:
+		f.types = defaultTypes &^ notTypes
+	}
+	return nil
+}
+
+type resourceType uint
+
+const (
+	typeOther resourceType = 1 << iota
+	typeScript
+	typeImage
+	typeStylesheet
+	typeObject
+	typeXHR
+	typeSubdocument
+	typeFont
+	typeMedia
+	typeWebsocket
+	typePing
+	typeDocument
+	typeElemHide
+	typeGenericHide
+
+	// defaultTypes are the types of filters without type options
+	defaultTypes = typeDocument - 1
+	allTypes     = typeDocument<<1 - 1
+)
+
+var typeOptions = map[string]resourceType{
+	"other":          typeOther,
+	"script":         typeScript,
+	"image":          typeImage,
+	"stylesheet":     typeStylesheet,
+	"css":            typeStylesheet,
+	"object":         typeObject,
+	"xmlhttprequest": typeXHR,
+	"xhr":            typeXHR,
+	"subdocument":    typeSubdocument,
+	"frame":          typeSubdocument,
+	"font":           typeFont,
+	"media":          typeMedia,
+	"websocket":      typeWebsocket,
+	"ping":           typePing,
+	"document":       typeDocument,
+	"doc":            typeDocument,
+	"elemhide":       typeElemHide,
+	"ehide":          typeElemHide,
+	"generichide":    typeGenericHide,
+	"ghide":          typeGenericHide,
+	"popup":          0,
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"strings"
+)
+
+// isHidingRule tells whether line is an element hiding rule, its domains
+// ending at i.
+func isHidingRule(line string, i int) bool {
+	if !strings.HasPrefix(line[i:], "##") && !strings.HasPrefix(line[i:], "#@#") &&
+		!strings.HasPrefix(line[i:], "#?#") && !strings.HasPrefix(line[i:], "#$#") &&
+		!strings.HasPrefix(line[i:], "#@?#") && !strings.HasPrefix(line[i:], "#@$#") {
+		return false
+	}
+	for _, c := range line[:i] {
+		if !(c == ',' || c == '~' || c == '.' || c == '-' || c == '*' || c < 128 && isTokenChar(byte(c)) || c >= 128) {
+			return false
+		}
+	}
+	return true
+}
+
+type hidingRule struct {
+	selector string
+	exclude  []string
+}
+
+func (r *hidingRule) appliesTo(host string) bool {
+	return !inDomains(host, r.exclude)
+}
+
+type hidingRules struct {
+	// generic rules by a class or id they need, e.g. ".ad" or "#banner"
+	generic  map[string][]hidingRule
+	specific map[string][]hidingRule
+	// exceptions by domain, "" for all
+	exceptions map[string]map[string]bool
+}
+
+func newHidingRules() hidingRules {
+	return hidingRules{
+		generic:    make(map[string][]hidingRule),
+		specific:   make(map[string][]hidingRule),
+		exceptions: make(map[string]map[string]bool),
+	}
+}
+
+// proceduralSelectors mark rules needing a content script rather than
+// CSS, from Adblock Plus and uBlock Origin.
+var proceduralSelectors = []string{
+	":-abp-", ":has-text(", ":xpath(", ":style(", ":remove(", ":upward(",
+	":matches-", ":min-text-length(", ":watch-attr(", ":others(", ":contains(",
+}
+
+func (h *hidingRules) add(domains, rule string) bool {
+	exception := strings.HasPrefix(rule, "#@#")
+	selector := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(rule, "#@#"), "##"))
+	if selector == "" || strings.HasPrefix(rule, "#?#") || strings.HasPrefix(rule, "#$#") ||
+		strings.HasPrefix(rule, "#@?#") || strings.HasPrefix(rule, "#@$#") ||
+		strings.HasPrefix(selector, "+js(") || strings.HasPrefix(selector, "^") ||
+		strings.ContainsAny(selector, "{}") {
+		return false
+	}
+	for _, p := range proceduralSelectors {
+		if strings.Contains(selector, p) {
+			return false
+		}
+	}
+
+	var include, exclude []string
+	for _, domain := range strings.Split(strings.ToLower(domains), ",") {
+		if strings.HasPrefix(domain, "~") {
+			exclude = append(exclude, domain[1:])
+		} else if domain != "" {
+			include = append(include, domain)
+		}
+	}
+	if exception {
+		if len(include) == 0 {
+			include = []string{""}
+		}
+		for _, domain := range include {
+			if h.exceptions[domain] == nil {
+				h.exceptions[domain] = make(map[string]bool)
+			}
+			h.exceptions[domain][selector] = true
+		}
+		return true
+	}
+	r := hidingRule{selector: selector, exclude: exclude}
+	if len(include) > 0 {
+		for _, domain := range include {
+			h.specific[domain] = append(h.specific[domain], r)
+		}
+		return true
+	}
+	key := selectorKey(selector)
+	if key == "" {
+		// would have to be sent to every page
+		return false
+	}
+	h.generic[key] = append(h.generic[key], r)
+	return true
+}
+
+func (h *hidingRules) excepted(selector, host string) bool {
+	if h.exceptions[""][selector] {
+		return true
+	}
+	for _, domain := range parentDomains(host) {
+		if h.exceptions[domain][selector] {
+			return true
+		}
+	}
+	return false
+}
+
+// selectorKey returns a class (".name") or id ("#name") an element must
+// have for the selector to match something, "" if there is none or the
+// selector is a list.
+func selectorKey(selector string) string {
+	key := ""
+	depth := 0
+	var quote byte
+	for i := 0; i < len(selector); i++ {
+		c := selector[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			return ""
+		case c == '\\':
+			return ""
+		case (c == '.' || c == '#') && depth == 0 && key == "":
+			j := i + 1
+			for j < len(selector) && (isTokenChar(selector[j]) && selector[j] != '%' || selector[j] == '-' || selector[j] == '_' || selector[j] >= 128) {
+				j++
+			}
+			if j > i+1 {
+				key = selector[i:j]
+			}
+			i = j - 1
+		}
+	}
+	return key
+}
@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// blockRequest is a request as seen by filters.
+type blockRequest struct {
+	url        string // lower case
+	rawURL     string
+	hostStart  int
+	hostEnd    int
+	host       string
+	page       *url.URL
+	pageHost   string
+	thirdParty bool
+	typ        resourceType
+}
+
+func newBlockRequest(r *http.Request) *blockRequest {
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	q := newPageRequest(&u, requestType(r))
+	if q.typ == typeDocument {
+		return q
+	}
+	q.page = nil
+	q.pageHost = ""
+	for _, h := range []string{"Referer", "Origin"} {
+		if page, err := url.Parse(r.Header.Get(h)); err == nil && page.Host != "" {
+			q.page = page
+			q.pageHost = strings.ToLower(page.Hostname())
+			break
+		}
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "cross-site":
+		q.thirdParty = true
+	case "same-site", "same-origin":
+	default:
+		q.thirdParty = q.pageHost != "" && registrableDomain(q.pageHost) != registrableDomain(q.host)
+	}
+	return q
+}
+
+// newPageRequest makes a request for u as a page of its own.
+func newPageRequest(u *url.URL, typ resourceType) *blockRequest {
+	raw := u.String()
+	host := strings.ToLower(u.Hostname())
+	q := &blockRequest{
+		url:      strings.ToLower(raw),
+		rawURL:   raw,
+		host:     host,
+		page:     u,
+		pageHost: host,
+		typ:      typ,
+	}
+	if i := strings.Index(q.url, "://"); i >= 0 {
+		q.hostStart = i + 3
+		if at := strings.IndexByte(q.url[q.hostStart:], '@'); at >= 0 && at < strings.IndexAny(q.url[q.hostStart:]+"/", "/?#") {
+			q.hostStart += at + 1
+		}
+	}
+	q.hostEnd = q.hostStart + len(host)
+	if q.hostEnd > len(q.url) || q.url[q.hostStart:q.hostEnd] != host {
+		// IPv6 literals in brackets
+		q.hostEnd = q.hostStart
+	}
+	return q
+}
+
+func registrableDomain(host string) string {
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+// requestType tells what a request is for, by the Sec-Fetch-Dest header
+// if the browser sends it, by guesswork otherwise.
+func requestType(r *http.Request) resourceType {
+	switch r.Header.Get("Sec-Fetch-Dest") {
+	case "script", "worker", "sharedworker", "serviceworker", "audioworklet", "paintworklet":
+		return typeScript
+	case "style", "xslt":
+		return typeStylesheet
+	case "image":
+		return typeImage
+	case "font":
+		return typeFont
+	case "audio", "video", "track":
+		return typeMedia
+	case "iframe", "frame", "fencedframe":
+		return typeSubdocument
+	case "object", "embed":
+		return typeObject
+	case "document":
+		return typeDocument
+	case "report":
+		return typePing
+	case "empty":
+		switch {
+		case strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+			return typeWebsocket
+		case r.Header.Get("Ping-To") != "" || r.Header.Get("Content-Type") == "text/ping":
+			return typePing
+		}
+		return typeXHR
+	case "":
+	default:
+		return typeOther
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+		return typeWebsocket
+	case r.Header.Get("X-Requested-With") == "XMLHttpRequest":
+		return typeXHR
+	case strings.HasPrefix(accept, "text/css"):
+		return typeStylesheet
+	case strings.HasPrefix(accept, "image/"):
+		return typeImage
+	case strings.HasPrefix(accept, "text/html"), strings.HasPrefix(accept, "application/xhtml+xml"):
+		return typeDocument
+	}
+	switch strings.ToLower(path.Ext(r.URL.Path)) {
+	case ".js", ".mjs":
+		return typeScript
+	case ".css":
+		return typeStylesheet
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif", ".svg", ".ico", ".bmp":
+		return typeImage
+	case ".woff", ".woff2", ".ttf", ".otf", ".eot":
+		return typeFont
+	case ".mp4", ".webm", ".ogg", ".mp3", ".m4a", ".m3u8", ".ts", ".wav":
+		return typeMedia
+	case ".html", ".htm":
+		return typeSubdocument
+	}
+	return typeOther
+}
+
+// isPlain tells whether the filter applies regardless of the page.
+func (f *filter) isPlain() bool {
+	return f.re == nil && f.thirdParty == 0 && len(f.include) == 0 && len(f.exclude) == 0
+}
+
+func (f *filter) matches(q *blockRequest) bool {
+	if f.types&q.typ == 0 {
+		return false
+	}
+	switch {
+	case f.thirdParty > 0 && !q.thirdParty, f.thirdParty < 0 && q.thirdParty:
+		return false
+	}
+	if len(f.include) > 0 && !inDomains(q.pageHost, f.include) || inDomains(q.pageHost, f.exclude) {
+		return false
+	}
+	if f.re != nil {
+		return f.re.MatchString(q.rawURL)
+	}
+	u := q.url
+	if f.matchCase {
+		u = q.rawURL
+	}
+	switch {
+	case f.hostAnchor:
+		for i := q.hostStart; i < q.hostEnd; i++ {
+			if (i == q.hostStart || u[i-1] == '.') && matchPattern(f.pattern, u[i:], f.end) {
+				return true
+			}
+		}
+		return false
+	case f.start:
+		return matchPattern(f.pattern, u, f.end)
+	}
+	literal := f.pattern
+	if i := strings.IndexAny(literal, "*^"); i >= 0 {
+		literal = literal[:i]
+	}
+	for i := 0; i <= len(u); i++ {
+		if literal != "" {
+			j := strings.Index(u[i:], literal)
+			if j < 0 {
+				return false
+			}
+			i += j
+		}
+		if matchPattern(f.pattern, u[i:], f.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern tells whether pattern matches the start of s, or all of s
+// if end is set. On a mismatch, it only backtracks to the last wildcard.
+func matchPattern(pattern, s string, end bool) bool {
+	p, i := 0, 0
+	star, mark := -1, 0
+	for {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+			continue
+		case p == len(pattern):
+			if !end || i == len(s) {
+				return true
+			}
+		case pattern[p] == '^' && i == len(s):
+			// the end of the URL counts as a separator
+			p++
+			continue
+		case i < len(s) && (pattern[p] == s[i] || pattern[p] == '^' && isSeparator(s[i])):
+			p++
+			i++
+			continue
+		}
+		if star < 0 || mark >= len(s) {
+			return false
+		}
+		mark++
+		p, i = star+1, mark
+	}
+}
+
+func isSeparator(c byte) bool {
+	return !(isTokenChar(c) || c == '_' || c == '-' || c == '.')
+}
+
+func isTokenChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '%'
+}
+
+// inDomains tells whether host is one of domains or a subdomain of one.
+func inDomains(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// parentDomains lists host and the domains it is a subdomain of.
+func parentDomains(host string) []string {
+	domains := []string{host}
+	for i, c := range host {
+		if c == '.' {
+			domains = append(domains, host[i+1:])
+		}
+	}
+	return domains
+}
+
+// filterSet indexes filters so a request is only checked against the few
+// that may match: host anchored filters by their domain, others by the
+// longest token of their pattern, as found between separators in the URL.
+type filterSet struct {
+	domains map[string][]*filter
+	tokens  map[string][]*filter
+	generic []*filter
+}
+
+func newFilterSet() filterSet {
+	return filterSet{
+		domains: make(map[string][]*filter),
+		tokens:  make(map[string][]*filter),
+	}
+}
+
+func (s *filterSet) add(f *filter) {
+	if f.hostAnchor {
+		n := 0
+		for n < len(f.pattern) && (isTokenChar(f.pattern[n]) && f.pattern[n] != '%' || f.pattern[n] == '-' || f.pattern[n] == '.') {
+			n++
+		}
+		if n > 0 && n < len(f.pattern) && strings.IndexByte("^/:", f.pattern[n]) >= 0 {
+			domain := strings.ToLower(f.pattern[:n])
+			s.domains[domain] = append(s.domains[domain], f)
+			return
+		}
+	}
+	if token := f.token(); token != "" {
+		s.tokens[token] = append(s.tokens[token], f)
+		return
+	}
+	s.generic = append(s.generic, f)
+}
+
+// token returns the longest run of token characters in the pattern which
+// must appear as a whole in matching URLs, "" if there is none.
+func (f *filter) token() string {
+	if f.re != nil {
+		return ""
+	}
+	best := ""
+	p := f.pattern
+	for i := 0; i < len(p); {
+		if !isTokenChar(p[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(p) && isTokenChar(p[j]) {
+			j++
+		}
+		bounded := (i > 0 && p[i-1] != '*' || i == 0 && (f.start || f.hostAnchor)) &&
+			(j < len(p) && p[j] != '*' || j == len(p) && f.end)
+		if bounded && j-i > len(best) {
+			best = p[i:j]
+		}
+		i = j
+	}
+	return strings.ToLower(best)
+}
+
+// match returns a filter matching q, nil if none does. Important filters
+// are preferred.
+func (s *filterSet) match(q *blockRequest) *filter {
+	var found *filter
+	check := func(filters []*filter) bool {
+		for _, f := range filters {
+			if (found == nil || f.important) && f.matches(q) {
+				found = f
+				if f.important {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if q.hostEnd > q.hostStart {
+		for _, domain := range parentDomains(q.host) {
+			if check(s.domains[domain]) {
+				return found
+			}
+		}
+	}
+	for i := 0; i < len(q.url); {
+		if !isTokenChar(q.url[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(q.url) && isTokenChar(q.url[j]) {
+			j++
+		}
+		if check(s.tokens[q.url[i:j]]) {
+			return found
+		}
+		i = j
+	}
+	check(s.generic)
+	return found
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+type blockedResponse struct {
+	contentType string
+	body        []byte
+	// estimate is the rough size of a typical ad or tracker response of
+	// the type, counted as avoided
+	estimate uint64
+}
+
+// transparentGif is a 1x1 transparent GIF.
+var transparentGif = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00" +
+	"!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+
+var blockedResponses = map[resourceType]blockedResponse{
+	typeScript:      {"application/javascript", nil, 20000},
+	typeStylesheet:  {"text/css", nil, 10000},
+	typeImage:       {"image/gif", transparentGif, 8000},
+	typeSubdocument: {"text/html", nil, 30000},
+	typeDocument:    {"text/html", nil, 30000},
+	typeObject:      {"", nil, 30000},
+	typeFont:        {"", nil, 30000},
+	typeMedia:       {"", nil, 100000},
+	typeXHR:         {"", nil, 2000},
+	typeWebsocket:   {"", nil, 2000},
+	typePing:        {"", nil, 500},
+	typeOther:       {"", nil, 2000},
+}
+
+// serveBlocked answers a blocked request with an empty response of the
+// right type, so pages don't wait for or retry it.
+func (p *Proxy) serveBlocked(w http.ResponseWriter, r *http.Request, typ resourceType) {
+	blocked := blockedResponses[typ]
+	log.Printf("blocked: %s", r.URL)
+	atomic.AddUint64(&p.BlockedCount, 1)
+	atomic.AddUint64(&p.BlockedBytesEstimate, blocked.estimate)
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	// the body is compy's own and empty, so any page may read it, but
+	// without credentials
+	if r.Header.Get("Origin") != "" {
+		h.Set("Access-Control-Allow-Origin", "*")
+	}
+	if blocked.contentType == "" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.Set("Content-Type", blocked.contentType)
+	h.Set("Content-Length", strconv.Itoa(len(blocked.body)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(blocked.body)
+	}
+}
+
+func (p *Proxy) blockingStats() string {
+	if p.blocker == nil {
+		return ""
+	}
+	return fmt.Sprintf("\n<li>blocked: %d requests, an estimated %d bytes avoided (typical sizes by type, not measured)</li>",
+		atomic.LoadUint64(&p.BlockedCount), atomic.LoadUint64(&p.BlockedBytesEstimate))
+}
@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxCoalescedBody bounds the response bodies kept for coalesced
+// requests. Larger responses aren't shared.
+const maxCoalescedBody = 8 << 20
+
+// variantHeaders are the request headers the origin's response may depend
+// on, besides those the transcoders read, so coalesced requests must agree
+// on them.
+var variantHeaders = []string{
+	"Accept-Language",
+	"Cache-Control",
+	"Cookie",
+	"Origin",
+	"Pragma",
+	"Sec-Fetch-Mode",
+}
+
+// conditionalHeaders make requests conditional, so their responses aren't
+// shared.
+var conditionalHeaders = []string{
+	"Range",
+	"If-Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+// coalescer tracks the requests in flight that identical requests may
+// share the response of.
+type coalescer struct {
+	timeout time.Duration
+	mu      sync.Mutex
+	calls   map[string]*call
+}
+
+// call is a request in flight. Its response is set before done is closed,
+// along with the size of the body read from the origin.
+type call struct {
+	done   chan struct{}
+	shared bool
+	status int
+	header http.Header
+	body   bytes.Buffer
+	read   uint64
+}
+
+func newCoalescer(timeout time.Duration) *coalescer {
+	return &coalescer{
+		timeout: timeout,
+		calls:   make(map[string]*call),
+	}
+}
+
+// coalesceKey returns the key of requests getting the same response from
+// the origin and the transcoders, "" for requests that mustn't share one.
+// headers are the headers of the request passed to the transcoders.
+func coalesceKey(r *http.Request, headers http.Header) string {
+	if r.Method != "GET" || r.ContentLength != 0 {
+		return ""
+	}
+	for _, h := range conditionalHeaders {
+		if r.Header.Get(h) != "" {
+			return ""
+		}
+	}
+	// shared caches mustn't reuse responses to authenticated requests
+	// unless the origin allows it (RFC 9111, section 3.5), which isn't
+	// known beforehand
+	if r.Header.Get("Authorization") != "" || hasDirective(r.Header, "Cache-Control", "no-store") {
+		return ""
+	}
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	var key strings.Builder
+	key.WriteString(u.String())
+	for _, list := range [][]string{variantHeaders, negotiatedHeaders, compyHeaders} {
+		for _, h := range list {
+			key.WriteString("\n" + h + ": " + strings.Join(headers.Values(h), ", "))
+		}
+	}
+	return key.String()
+}
+
+func hasDirective(h http.Header, field, directive string) bool {
+	for _, v := range h.Values(field) {
+		for _, d := range strings.Split(v, ",") {
+			if name := strings.SplitN(d, "=", 2)[0]; strings.EqualFold(strings.TrimSpace(name), directive) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// join returns the call in flight for key, or a new one the caller leads
+// if there is none.
+func (c *coalescer) join(key string) (cl *call, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cl, ok := c.calls[key]; ok {
+		return cl, false
+	}
+	cl = &call{done: make(chan struct{})}
+	c.calls[key] = cl
+	return cl, true
+}
+
+// finish releases the requests waiting for a call, sharing its response
+// with them if shared is set.
+func (c *coalescer) finish(key string, cl *call, shared bool) {
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	cl.shared = shared
+	close(cl.done)
+}
+
+// wait tells whether the response to a call can be shared once it is
+// done, giving up after timeout.
+func (cl *call) wait(timeout time.Duration) bool {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-cl.done:
+		return cl.shared
+	case <-t.C:
+		return false
+	}
+}
+
+func (cl *call) serve(w http.ResponseWriter) error {
+	for k, v := range cl.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.WriteHeader(cl.status)
+	_, err := w.Write(cl.body.Bytes())
+	return err
+}
+
+// serveCall serves a request the response to the call it joined, counting
+// and capturing it like a fetched one.
+func (p *Proxy) serveCall(w http.ResponseWriter, r *http.Request, cl *call) error {
+	rec := p.capture.begin(r)
+	err := cl.serve(w)
+	if herr := rec.coalesced(r, cl.status, cl.header, cl.body.Bytes()); herr != nil {
+		log.Printf("error writing HAR: %s", herr)
+	}
+	atomic.AddUint64(&p.ReadCount, cl.read)
+	atomic.AddUint64(&p.WriteCount, uint64(cl.body.Len()))
+	return err
+}
+
+// shareable tells whether the response to a call may be served to other
+// clients: it is complete and cacheable, and not personal.
+func (cl *call) shareable() bool {
+	switch cl.status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMovedPermanently, http.StatusPermanentRedirect,
+		http.StatusNotFound, http.StatusGone:
+	default:
+		return false
+	}
+	if cl.header.Get("Set-Cookie") != "" || hasDirective(cl.header, "Vary", "*") {
+		return false
+	}
+	for _, directive := range []string{"private", "no-store", "no-cache"} {
+		if hasDirective(cl.header, "Cache-Control", directive) {
+			return false
+		}
+	}
+	return true
+}
+
+// callRecorder passes the response of the request leading a call through,
+// keeping a copy for the call. The body is sent to the leader's client from
+// another goroutine, so that a slow client holds up neither transcoding nor
+// the requests waiting for the call. Beyond maxCoalescedBody, which the
+// call doesn't keep, writes wait for the client.
+type callRecorder struct {
+	http.ResponseWriter
+	call     *call
+	overflow bool
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending [][]byte
+	queued  int
+	closed  bool
+	err     error
+	sent    chan struct{}
+}
+
+func newCallRecorder(w http.ResponseWriter, cl *call) *callRecorder {
+	rec := &callRecorder{ResponseWriter: w, call: cl, sent: make(chan struct{})}
+	rec.cond = sync.NewCond(&rec.mu)
+	go rec.send()
+	return rec
+}
+
+func (w *callRecorder) WriteHeader(status int) {
+	if w.call.header != nil {
+		return
+	}
+	w.call.status = status
+	w.call.header = w.Header().Clone()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *callRecorder) Write(b []byte) (int, error) {
+	if w.call.header == nil {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if w.call.body.Len()+len(b) > maxCoalescedBody {
+			w.overflow = true
+			w.call.body = bytes.Buffer{}
+		} else {
+			w.call.body.Write(b)
+		}
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.queued > maxCoalescedBody && w.err == nil {
+		w.cond.Wait()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.pending = append(w.pending, append([]byte(nil), b...))
+	w.queued += len(b)
+	w.cond.Broadcast()
+	return len(b), nil
+}
+
+// send writes the queued body to the client until the recorder is closed
+// and the queue drained, or writing fails.
+func (w *callRecorder) send() {
+	defer close(w.sent)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for {
+		for len(w.pending) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if len(w.pending) == 0 {
+			return
+		}
+		b := w.pending[0]
+		w.pending = w.pending[1:]
+		w.mu.Unlock()
+		_, err := w.ResponseWriter.Write(b)
+		w.mu.Lock()
+		w.queued -= len(b)
+		if err != nil {
+			w.err = err
+			w.pending, w.queued = nil, 0
+		}
+		w.cond.Broadcast()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close waits for the body to be sent to the client, returning the error
+// writing it.
+func (w *callRecorder) close() error {
+	w.mu.Lock()
+	w.closed = true
+	w.cond.Broadcast()
+	w.mu.Unlock()
+	<-w.sent
+	return w.err
+}
+
+// coalesce serves a request from the response to an identical one in
+// flight, or fetches it for those that follow.
+func (p *Proxy) coalesce(w http.ResponseWriter, r *http.Request, headers http.Header, key string) (err error) {
+	cl, leader := p.coalescer.join(key)
+	if !leader {
+		if cl.wait(p.coalescer.timeout) {
+			log.Printf("coalesced: %s", r.URL)
+			return p.serveCall(w, r, cl)
+		}
+		return p.fetch(w, r, headers)
+	}
+	rec := newCallRecorder(w, cl)
+	defer func() {
+		if sendErr := rec.close(); err == nil {
+			err = sendErr
+		}
+	}()
+	shared := false
+	// runs first: the body is complete, the leader's client may not have it
+	// yet
+	defer func() {
+		p.coalescer.finish(key, cl, shared)
+	}()
+	err = p.fetch(rec, r, headers)
+	shared = err == nil && !rec.overflow && cl.header != nil && cl.shareable()
+	return err
+}
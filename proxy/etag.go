@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// etagVariant separates the origin's ETag from the variant in the ETags
+// of transformed responses.
+const etagVariant = "-compy-"
+
+// digestHeaders are checksums of the body, which don't survive
+// transforming it.
+var digestHeaders = []string{"Content-MD5", "Digest", "Content-Digest", "Repr-Digest"}
+
+// parseETags splits a list of entity tags, e.g. an If-None-Match header.
+// Malformed entries are dropped.
+func parseETags(list string) []string {
+	var tags []string
+	for list != "" {
+		list = strings.TrimLeft(list, " \t,")
+		if strings.HasPrefix(list, "*") {
+			tags = append(tags, "*")
+			list = list[1:]
+			continue
+		}
+		start := 0
+		if strings.HasPrefix(list, "W/") {
+			start = 2
+		}
+		if len(list) <= start || list[start] != '"' {
+			break
+		}
+		end := strings.IndexByte(list[start+1:], '"')
+		if end < 0 {
+			break
+		}
+		end += start + 2
+		tags = append(tags, list[:end])
+		list = list[end:]
+	}
+	return tags
+}
+
+// opaqueTag returns the quoted part of an entity tag without the quotes.
+func opaqueTag(etag string) (string, bool) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return "", false
+	}
+	return etag[1 : len(etag)-1], true
+}
+
+// negotiatedHeaders are the standard request headers the transcoders read
+// to choose the format and size of their output.
+var negotiatedHeaders = []string{
+	"Accept",
+	"Accept-Encoding",
+	"DPR",
+	"Sec-CH-DPR",
+	"Sec-CH-Width",
+	"Sec-Fetch-Dest",
+	"User-Agent",
+	"Width",
+}
+
+// compyHeaders are compy's own request headers read by the transcoders.
+// Unlike the negotiated headers, they select variants of the same type and
+// encoding.
+var compyHeaders = []string{QualityHeader, PlaceholderHeader}
+
+// variant returns a hash of what the transformed response to a request
+// with the given transcoder headers depends on, besides the origin's
+// response: the transcoder settings and the request headers the transcoders
+// read. It starts the variant part of ETags, so that revalidating a
+// variant checks it is still the one the request would get.
+func (p *Proxy) variant(headers http.Header) string {
+	sum := fnv.New32a()
+	fmt.Fprint(sum, p.settings)
+	for _, list := range [][]string{negotiatedHeaders, compyHeaders} {
+		for _, h := range list {
+			fmt.Fprintf(sum, "\n%s: %s", h, strings.Join(headers.Values(h), ", "))
+		}
+	}
+	return fmt.Sprintf("%08x", sum.Sum32())
+}
+
+// variantETag derives the ETag of a transformed body from the origin's.
+// It is weak, as the body is only equivalent to the original, and tells
+// variants apart by the variant of the request and their type and
+// encoding.
+func variantETag(etag string, h http.Header, variant string) (string, bool) {
+	opaque, ok := opaqueTag(etag)
+	if !ok {
+		return "", false
+	}
+	sum := fnv.New32a()
+	fmt.Fprintf(sum, "%s;%s", h.Get("Content-Type"), h.Get("Content-Encoding"))
+	return fmt.Sprintf(`W/"%s%s%s%08x"`, opaque, etagVariant, variant, sum.Sum32()), true
+}
+
+// revalidateVariants replaces the variant ETags in the If-None-Match header
+// of a request by the origin's ETags they were derived from. Variants other
+// than the one the request would get now, as after the settings or its
+// headers changed, are dropped, so that the origin sends the body again
+// rather than a 304. It returns the variant ETags by the origin's opaque
+// tags, to put back into a 304.
+func revalidateVariants(h http.Header, variant string) map[string]string {
+	values := h.Values("If-None-Match")
+	if len(values) == 0 {
+		return nil
+	}
+	variants := make(map[string]string)
+	var tags []string
+	for _, tag := range parseETags(strings.Join(values, ",")) {
+		opaque, _ := opaqueTag(tag)
+		i := strings.LastIndex(opaque, etagVariant)
+		if !strings.HasPrefix(tag, "W/") || i < 0 {
+			tags = append(tags, tag)
+			continue
+		}
+		if !strings.HasPrefix(opaque[i+len(etagVariant):], variant) {
+			// nor may the date of the stale variant get a 304
+			h.Del("If-Modified-Since")
+			continue
+		}
+		origin := opaque[:i]
+		// the origin compares weakly, whichever kind its ETag was
+		tags = append(tags, `"`+origin+`"`, `W/"`+origin+`"`)
+		variants[origin] = tag
+	}
+	if len(tags) == 0 {
+		h.Del("If-None-Match")
+	} else {
+		h.Set("If-None-Match", strings.Join(tags, ", "))
+	}
+	return variants
+}
+
+// notModifiedVariant sets the ETag of a 304 response to the variant the
+// client revalidated.
+func notModifiedVariant(resp *http.Response, variants map[string]string) {
+	if resp.StatusCode != http.StatusNotModified {
+		return
+	}
+	if opaque, ok := opaqueTag(resp.Header.Get("ETag")); ok && variants[opaque] != "" {
+		resp.Header.Set("ETag", variants[opaque])
+	}
+}
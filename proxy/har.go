@@ -0,0 +1,530 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HAR is an HTTP Archive 1.2 document, as written by the capture mode and
+// read back by tools replaying captured traffic.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HAREntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Client          string      `json:"_client,omitempty"`
+	Error           string      `json:"_error,omitempty"`
+	// Coalesced marks responses shared from an identical request, whose
+	// entry has the exchange with the origin.
+	Coalesced bool `json:"_coalesced,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARNameValue `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// HARResponse describes the response as it was sent to the client.
+// The upstream response before transcoding is kept in the custom
+// _original fields.
+type HARResponse struct {
+	Status          int            `json:"status"`
+	StatusText      string         `json:"statusText"`
+	HTTPVersion     string         `json:"httpVersion"`
+	Cookies         []HARNameValue `json:"cookies"`
+	Headers         []HARNameValue `json:"headers"`
+	Content         HARContent     `json:"content"`
+	RedirectURL     string         `json:"redirectURL"`
+	HeadersSize     int64          `json:"headersSize"`
+	BodySize        int64          `json:"bodySize"`
+	OriginalHeaders []HARNameValue `json:"_originalHeaders,omitempty"`
+	Original        *HARContent    `json:"_original,omitempty"`
+}
+
+// HARContent holds a body as it went over the wire, i.e. still
+// content-encoded.
+type HARContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Body returns the recorded body bytes, if any.
+func (c *HARContent) Body() ([]byte, error) {
+	if c.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(c.Text)
+	}
+	return []byte(c.Text), nil
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// HARTimings are in milliseconds, -1 meaning not applicable.
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// Header converts recorded name/value pairs back to an http.Header.
+func HARHeader(nvs []HARNameValue) http.Header {
+	h := make(http.Header)
+	for _, nv := range nvs {
+		h.Add(nv.Name, nv.Value)
+	}
+	return h
+}
+
+// ReadHAR parses a HAR file.
+func ReadHAR(path string) (*HAR, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	har := &HAR{}
+	if err := json.Unmarshal(data, har); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return har, nil
+}
+
+type harCapture struct {
+	dir    string
+	bodies bool
+
+	mu      sync.Mutex
+	global  *harSession
+	clients map[string]*harSession
+}
+
+// harSession streams entries to a HAR file, which is kept valid after
+// every entry by rewriting the closing brackets behind it.
+type harSession struct {
+	mu      sync.Mutex
+	file    *os.File
+	end     int64
+	entries int
+}
+
+const harTrailer = "\n]}}\n"
+
+func newHarCapture(dir string, bodies bool) *harCapture {
+	return &harCapture{
+		dir:     dir,
+		bodies:  bodies,
+		clients: make(map[string]*harSession),
+	}
+}
+
+func (c *harCapture) newSession(name string) (*harSession, error) {
+	base := fmt.Sprintf("compy-%s-%s", name, time.Now().Format("20060102-150405.000"))
+	var file *os.File
+	var err error
+	// never overwrite an earlier capture
+	for i := 0; ; i++ {
+		path := filepath.Join(c.dir, base+".har")
+		if i > 0 {
+			path = filepath.Join(c.dir, fmt.Sprintf("%s-%d.har", base, i))
+		}
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	creator, _ := json.Marshal(HARCreator{Name: "compy", Version: "1"})
+	header := fmt.Sprintf(`{"log":{"version":"1.2","creator":%s,"entries":[`, creator)
+	if _, err := io.WriteString(file, header+harTrailer); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &harSession{file: file, end: int64(len(header))}, nil
+}
+
+func (c *harCapture) start(client string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client == "" {
+		if c.global == nil {
+			s, err := c.newSession("all")
+			if err != nil {
+				return err
+			}
+			c.global = s
+		}
+		return nil
+	}
+	if _, ok := c.clients[client]; !ok {
+		s, err := c.newSession(strings.NewReplacer(":", "_", ".", "_").Replace(client))
+		if err != nil {
+			return err
+		}
+		c.clients[client] = s
+	}
+	return nil
+}
+
+func (c *harCapture) stop(client string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var s *harSession
+	if client == "" {
+		s, c.global = c.global, nil
+	} else {
+		s = c.clients[client]
+		delete(c.clients, client)
+	}
+	if s == nil {
+		return nil
+	}
+	return s.close()
+}
+
+func (c *harCapture) capturing(client string) (global, own bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, own = c.clients[client]
+	return c.global != nil, own
+}
+
+func (c *harCapture) sessions(client string) []*harSession {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var sessions []*harSession
+	if c.global != nil {
+		sessions = append(sessions, c.global)
+	}
+	if s, ok := c.clients[client]; ok {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (s *harSession) add(entry *HAREntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		// stopped while the request was served
+		return nil
+	}
+	if s.entries > 0 {
+		data = append([]byte(",\n"), data...)
+	} else {
+		data = append([]byte("\n"), data...)
+	}
+	if _, err := s.file.WriteAt(append(data, harTrailer...), s.end); err != nil {
+		return err
+	}
+	s.end += int64(len(data))
+	s.entries++
+	return nil
+}
+
+func (s *harSession) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// harRecorder collects a single entry while a request is being served.
+// A nil recorder is valid and records nothing.
+type harRecorder struct {
+	sessions []*harSession
+	client   string
+	bodies   bool
+
+	start time.Time
+	// mu guards the connection timings and serverAddr, set by the
+	// transport from its own goroutines
+	mu           sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	responded    time.Time
+	serverAddr   string
+
+	original   bytes.Buffer
+	transcoded bytes.Buffer
+}
+
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (c *harCapture) begin(r *http.Request) *harRecorder {
+	if c == nil {
+		return nil
+	}
+	client := clientHost(r)
+	sessions := c.sessions(client)
+	if len(sessions) == 0 {
+		return nil
+	}
+	return &harRecorder{
+		sessions: sessions,
+		client:   client,
+		bodies:   c.bodies,
+		start:    time.Now(),
+	}
+}
+
+func (h *harRecorder) trace(r *http.Request) *http.Request {
+	if h == nil {
+		return r
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { h.mark(&h.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { h.mark(&h.dnsDone) },
+		ConnectStart:      func(string, string) { h.mark(&h.connectStart) },
+		ConnectDone:       func(string, string, error) { h.mark(&h.connectDone) },
+		TLSHandshakeStart: func() { h.mark(&h.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { h.mark(&h.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			h.mu.Lock()
+			h.serverAddr = info.Conn.RemoteAddr().String()
+			h.mu.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { h.mark(&h.wroteRequest) },
+		GotFirstResponseByte: func() { h.mark(&h.firstByte) },
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
+
+// mark sets a connection timing to now.
+func (h *harRecorder) mark(t *time.Time) {
+	h.mu.Lock()
+	*t = time.Now()
+	h.mu.Unlock()
+}
+
+func (h *harRecorder) tap(w *ResponseWriter, r *ResponseReader) {
+	if h == nil {
+		return
+	}
+	h.responded = time.Now()
+	if h.bodies {
+		r.Reader = io.TeeReader(r.Reader, &h.original)
+		w.Writer = io.MultiWriter(w.Writer, &h.transcoded)
+	}
+}
+
+func (h *harRecorder) finish(req *http.Request, w *ResponseWriter, r *ResponseReader) error {
+	if h == nil {
+		return nil
+	}
+	end := time.Now()
+	resp := r.r
+	entry := h.entry(req, end)
+	entry.Response = HARResponse{
+		Status:          w.statusCode,
+		StatusText:      http.StatusText(w.statusCode),
+		HTTPVersion:     resp.Proto,
+		Cookies:         []HARNameValue{},
+		Headers:         harHeaders(w.Header()),
+		Content:         h.content(w.Header(), w.rw.Count(), &h.transcoded),
+		RedirectURL:     w.Header().Get("Location"),
+		HeadersSize:     -1,
+		BodySize:        int64(w.rw.Count()),
+		OriginalHeaders: harHeaders(resp.Header),
+	}
+	original := h.content(resp.Header, r.counter.Count(), &h.original)
+	entry.Response.Original = &original
+	entry.Timings.Receive = millis(h.responded, end)
+	if entry.Timings.Wait < 0 {
+		entry.Timings.Wait = millis(h.start, h.responded)
+	}
+	return h.add(entry)
+}
+
+// coalesced records a request served the response to an identical one.
+// The entry has no original response nor timings of its own beyond the
+// wait for the other request.
+func (h *harRecorder) coalesced(req *http.Request, status int, header http.Header, body []byte) error {
+	if h == nil {
+		return nil
+	}
+	end := time.Now()
+	entry := h.entry(req, end)
+	entry.Response = HARResponse{
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		HTTPVersion: req.Proto,
+		Cookies:     []HARNameValue{},
+		Headers:     harHeaders(header),
+		Content:     h.content(header, uint64(len(body)), bytes.NewBuffer(body)),
+		RedirectURL: header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    int64(len(body)),
+	}
+	entry.Coalesced = true
+	entry.Timings.Wait = millis(h.start, end)
+	return h.add(entry)
+}
+
+// fail records a request that couldn't be forwarded. Like browsers do, the
+// entry has status 0 and the error in the custom _error field.
+func (h *harRecorder) fail(req *http.Request, ferr error) error {
+	if h == nil {
+		return nil
+	}
+	entry := h.entry(req, time.Now())
+	entry.Response = HARResponse{
+		Cookies:     []HARNameValue{},
+		Headers:     []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	entry.Error = ferr.Error()
+	if entry.Timings.Wait < 0 {
+		entry.Timings.Wait = 0
+	}
+	return h.add(entry)
+}
+
+// entry fills in the request and the connection timings of an entry.
+func (h *harRecorder) entry(req *http.Request, end time.Time) *HAREntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry := &HAREntry{
+		StartedDateTime: h.start,
+		Time:            millis(h.start, end),
+		Request: HARRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     []HARNameValue{},
+			Headers:     harHeaders(req.Header),
+			QueryString: harQuery(req),
+			HeadersSize: -1,
+			BodySize:    req.ContentLength,
+		},
+		Timings: HARTimings{
+			Blocked: -1,
+			DNS:     millis(h.dnsStart, h.dnsDone),
+			Connect: millis(h.connectStart, h.connectDone),
+			SSL:     millis(h.tlsStart, h.tlsDone),
+			Send:    millis(h.connectDone, h.wroteRequest),
+			Wait:    millis(h.wroteRequest, h.firstByte),
+			Receive: 0,
+		},
+		Client: h.client,
+	}
+	if host, _, err := net.SplitHostPort(h.serverAddr); err == nil {
+		entry.ServerIPAddress = host
+	}
+	if entry.Timings.Send < 0 {
+		entry.Timings.Send = 0
+	}
+	return entry
+}
+
+func (h *harRecorder) add(entry *HAREntry) error {
+	var err error
+	for _, s := range h.sessions {
+		if e := s.add(entry); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (h *harRecorder) content(header http.Header, size uint64, body *bytes.Buffer) HARContent {
+	c := HARContent{
+		Size:     int64(size),
+		MimeType: header.Get("Content-Type"),
+	}
+	if h.bodies && body.Len() > 0 {
+		c.Text = base64.StdEncoding.EncodeToString(body.Bytes())
+		c.Encoding = "base64"
+	}
+	return c
+}
+
+func millis(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() {
+		return -1
+	}
+	return float64(to.Sub(from)) / float64(time.Millisecond)
+}
+
+func harHeaders(h http.Header) []HARNameValue {
+	nvs := []HARNameValue{}
+	for k, vs := range h {
+		for _, v := range vs {
+			nvs = append(nvs, HARNameValue{Name: k, Value: v})
+		}
+	}
+	return nvs
+}
+
+func harQuery(r *http.Request) []HARNameValue {
+	nvs := []HARNameValue{}
+	for k, vs := range r.URL.Query() {
+		for _, v := range vs {
+			nvs = append(nvs, HARNameValue{Name: k, Value: v})
+		}
+	}
+	return nvs
+}
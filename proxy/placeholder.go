@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// PlaceholderHeader selects placeholder mode for a request: "on" asks for
+// images to be replaced by placeholders, "off" for the real image even if
+// the client has placeholders enabled.
+const PlaceholderHeader = "X-Compy-Placeholder"
+
+// PlaceholderParam selects placeholder mode like PlaceholderHeader, as a
+// query parameter. The placeholder script adds it to the URL of tapped
+// images, which then load like any other image.
+const PlaceholderParam = "compy-placeholder"
+
+// placeholders tracks the clients that enabled placeholder mode from the
+// local page.
+type placeholders struct {
+	mu      sync.Mutex
+	clients map[string]bool
+}
+
+func newPlaceholders() *placeholders {
+	return &placeholders{clients: make(map[string]bool)}
+}
+
+func (p *placeholders) set(client string, on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if on {
+		p.clients[client] = true
+	} else {
+		delete(p.clients, client)
+	}
+}
+
+func (p *placeholders) enabled(client string) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.clients[client]
+}
+
+// mode returns the placeholder mode of a request: the one it chose with
+// PlaceholderParam or PlaceholderHeader, else "on" for clients in
+// placeholder mode. The parameter is removed from the URL, the origin
+// doesn't know it.
+func (p *placeholders) mode(r *http.Request) string {
+	mode := r.Header.Get(PlaceholderHeader)
+	if param, ok := removeQueryParam(r.URL, PlaceholderParam); ok {
+		mode = param
+	}
+	if mode != "" || !p.enabled(clientHost(r)) {
+		return mode
+	}
+	return "on"
+}
+
+// removeQueryParam removes a parameter from the query of u, leaving the
+// rest as it is, and returns its last value.
+func removeQueryParam(u *url.URL, name string) (string, bool) {
+	if !strings.Contains(u.RawQuery, name) {
+		return "", false
+	}
+	var kept []string
+	value, found := "", false
+	for _, kv := range strings.Split(u.RawQuery, "&") {
+		k, v, _ := strings.Cut(kv, "=")
+		if k != name {
+			kept = append(kept, kv)
+			continue
+		}
+		value, _ = url.QueryUnescape(v)
+		found = true
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	return value, found
+}
+
+func (p *Proxy) placeholderControls(r *http.Request) string {
+	if p.placeholders == nil {
+		return ""
+	}
+	on := p.placeholders.enabled(clientHost(r))
+	action := "on"
+	if on {
+		action = "off"
+	}
+	return fmt.Sprintf(`
+<h2>image placeholders</h2>
+<p>Replace images with tiny previews, tap an image to load it.</p>
+<ul>
+<li>this client (%s): %t <form method="post" action="/placeholders">
+<input type="submit" name="action" value="%s">
+</form></li>
+</ul>`, clientHost(r), on, action)
+}
+
+func (p *Proxy) handlePlaceholders(w http.ResponseWriter, r *http.Request) error {
+	if p.placeholders == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	switch r.FormValue("action") {
+	case "on":
+		p.placeholders.set(clientHost(r), true)
+	case "off":
+		p.placeholders.set(clientHost(r), false)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
 	"log"
@@ -14,26 +15,41 @@ import (
 	"os"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 type Proxy struct {
-	transcoders map[string]Transcoder
-	ml          *mitmListener
-	ReadCount   uint64
-	WriteCount  uint64
-	user        string
-	pass        string
-	host        string
-	cert        string
+	transcoders  *registry
+	ml           *mitmListener
+	ReadCount    uint64
+	WriteCount   uint64
+	BlockedCount uint64
+	// BlockedBytesEstimate adds up typical response sizes of the types
+	// of the blocked requests, the actual responses are never fetched.
+	BlockedBytesEstimate uint64
+	user                 string
+	pass                 string
+	host                 string
+	cert                 string
+	capture              *harCapture
+	sniff                bool
+	placeholders         *placeholders
+	blocker              *Blocker
+	coalescer            *coalescer
+	settings             string
 }
 
 type Transcoder interface {
 	Transcode(*ResponseWriter, *ResponseReader, http.Header) error
 }
 
+// QualityHeader sets the JPEG quality of the images of a request,
+// overriding the configured one.
+const QualityHeader = "X-Compy-Quality"
+
 func New(host string, cert string) *Proxy {
 	p := &Proxy{
-		transcoders: make(map[string]Transcoder),
+		transcoders: newRegistry(),
 		ml:          nil,
 		host:        host,
 		cert:        cert,
@@ -74,8 +90,76 @@ func (p *Proxy) SetAuthentication(user, pass string) {
 	p.pass = pass
 }
 
+// EnableCapture allows recording proxied traffic as HAR files in dir.
+// Capturing is toggled per client or globally from the local page.
+func (p *Proxy) EnableCapture(dir string, bodies bool) {
+	p.capture = newHarCapture(dir, bodies)
+}
+
+// SetSniffing enables choosing transcoders by the leading bytes of the
+// body when the declared content type is missing, generic or wrong.
+// Responses with X-Content-Type-Options: nosniff are never rerouted.
+func (p *Proxy) SetSniffing(sniff bool) {
+	p.sniff = sniff
+}
+
+// EnablePlaceholders lets clients switch to placeholder mode from the
+// local page, so their requests carry PlaceholderHeader. Requests may
+// also set the header themselves.
+func (p *Proxy) EnablePlaceholders() {
+	p.placeholders = newPlaceholders()
+}
+
+// EnableBlocking answers requests blocked by b with empty responses
+// instead of forwarding them, and refuses connections to hosts it blocks
+// entirely. Blocked requests and an estimate of the bytes avoided are
+// counted in BlockedCount and BlockedBytesEstimate.
+func (p *Proxy) EnableBlocking(b *Blocker) {
+	p.blocker = b
+}
+
+// EnableCoalescing lets identical concurrent GET requests share the
+// response to the first one, if it is cacheable, rather than each fetching
+// and transcoding it. The others wait for it at most timeout before
+// fetching it themselves.
+func (p *Proxy) EnableCoalescing(timeout time.Duration) {
+	p.coalescer = newCoalescer(timeout)
+}
+
+// SetTranscoderSettings sets a summary of the configuration of the
+// transcoders, e.g. a hash of the flags they were set up from. It goes into
+// the ETags of transformed responses, so that they change with it.
+func (p *Proxy) SetTranscoderSettings(settings string) {
+	p.settings = settings
+}
+
+// AddTranscoder registers a transcoder for a media type pattern, see
+// AddTranscoderPriority. It panics if the pattern is invalid.
 func (p *Proxy) AddTranscoder(contentType string, transcoder Transcoder) {
-	p.transcoders[contentType] = transcoder
+	if err := p.AddTranscoderPriority(contentType, 0, transcoder); err != nil {
+		panic(err)
+	}
+}
+
+// AddTranscoderPriority registers a transcoder for an exact media type
+// with optional parameters, a wildcard such as "image/*" or a structured
+// syntax suffix such as "+json". When several patterns match a response,
+// the highest priority wins, then the most specific pattern. Registering
+// the same pattern again replaces the previous transcoder.
+func (p *Proxy) AddTranscoderPriority(pattern string, priority int, transcoder Transcoder) error {
+	return p.transcoders.add(pattern, priority, transcoder)
+}
+
+// SetFallbackTranscoder sets the transcoder used for responses no
+// registered pattern matches.
+func (p *Proxy) SetFallbackTranscoder(transcoder Transcoder) {
+	p.transcoders.setFallback(transcoder)
+}
+
+// Transcoders lists the registered transcoders in the order they are
+// considered.
+func (p *Proxy) Transcoders() []TranscoderInfo {
+	return p.transcoders.list()
 }
 
 func (p *Proxy) Start(host string) error {
@@ -109,18 +193,30 @@ func (p *Proxy) checkHttpBasicAuth(auth string) bool {
 	return true
 }
 
+// authorized tells whether r carries the configured credentials, if any.
+func (p *Proxy) authorized(r *http.Request) bool {
+	return p.user == "" || p.checkHttpBasicAuth(r.Header.Get("Proxy-Authorization"))
+}
+
+func (p *Proxy) requireAuth(w http.ResponseWriter) {
+	w.Header().Set("Proxy-Authenticate", "Basic realm=\"Compy\"")
+	w.WriteHeader(http.StatusProxyAuthRequired)
+}
+
 func (p *Proxy) handle(w http.ResponseWriter, r *http.Request) error {
 	// TODO: only HTTPS?
-	if p.user != "" {
-		if !p.checkHttpBasicAuth(r.Header.Get("Proxy-Authorization")) {
-			w.Header().Set("Proxy-Authenticate", "Basic realm=\"Compy\"")
-			w.WriteHeader(http.StatusProxyAuthRequired)
-			return nil
-		}
-		r.Header.Del("Proxy-Authorization")
+	if !p.authorized(r) {
+		p.requireAuth(w)
+		return nil
 	}
 
 	if r.Method == "CONNECT" {
+		if p.blocker.BlocksHost(r.Host) {
+			log.Printf("blocked: %s", r.Host)
+			atomic.AddUint64(&p.BlockedCount, 1)
+			w.WriteHeader(http.StatusForbidden)
+			return nil
+		}
 		return p.handleConnect(w, r)
 	}
 
@@ -132,22 +228,83 @@ func (p *Proxy) handle(w http.ResponseWriter, r *http.Request) error {
 		return p.handleLocalRequest(w, r)
 	}
 
-	resp, err := forward(r)
+	if p.user != "" {
+		r.Header.Del("Proxy-Authorization")
+	}
+
+	if typ, blocked := p.blocker.match(r); blocked {
+		p.serveBlocked(w, r, typ)
+		return nil
+	}
+
+	headers := p.transcoderHeaders(r)
+	if key := coalesceKey(r, headers); p.coalescer != nil && key != "" {
+		return p.coalesce(w, r, headers, key)
+	}
+	return p.fetch(w, r, headers)
+}
+
+// transcoderHeaders returns the request headers the transcoders see, with
+// the placeholder mode of the request. compy's own X-Compy headers are
+// removed from r, the origin doesn't know them.
+func (p *Proxy) transcoderHeaders(r *http.Request) http.Header {
+	mode := p.placeholders.mode(r)
+	headers := r.Header.Clone()
+	for name := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-compy-") {
+			r.Header.Del(name)
+		}
+	}
+	if mode != "" {
+		headers.Set(PlaceholderHeader, mode)
+	}
+	return headers
+}
+
+// fetch forwards a request and transcodes the response for a client
+// sending headers.
+func (p *Proxy) fetch(w http.ResponseWriter, r *http.Request, headers http.Header) error {
+	variants := revalidateVariants(r.Header, p.variant(headers))
+	rec := p.capture.begin(r)
+	resp, err := forward(rec.trace(r))
+	if err == nil && p.transcodesPartial(r, resp) {
+		// transcoders need the whole body, and their output can't be
+		// served in ranges
+		resp.Body.Close()
+		log.Printf("refetching %s without Range", r.URL)
+		whole := r.Clone(r.Context())
+		whole.Header.Del("Range")
+		whole.Header.Del("If-Range")
+		resp, err = forward(rec.trace(whole))
+	}
 	if err != nil {
+		if herr := rec.fail(r, err); herr != nil {
+			log.Printf("error writing HAR: %s", herr)
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return fmt.Errorf("error forwarding request: %s", err)
 	}
 	defer resp.Body.Close()
+	notModifiedVariant(resp, variants)
 	user_agent := r.Header.Get("User-Agent")
 	w.Header().Set("User-Agent", user_agent)
 	rw := newResponseWriter(w)
+	rw.via = strings.TrimPrefix(resp.Proto, "HTTP/") + " compy"
 	rr := newResponseReader(resp)
-	err = p.proxyResponse(rw, rr, r.Header)
+	rec.tap(rw, rr)
+	err = p.proxyResponse(rw, rr, headers)
+	if herr := rec.finish(r, rw, rr); herr != nil {
+		log.Printf("error writing HAR: %s", herr)
+	}
 	read := rr.counter.Count()
 	written := rw.rw.Count()
 	log.Printf("transcoded: %d -> %d (%3.1f%%)", read, written, float64(written)/float64(read)*100)
 	atomic.AddUint64(&p.ReadCount, read)
 	atomic.AddUint64(&p.WriteCount, written)
+	if cr, ok := w.(*callRecorder); ok {
+		// counted again for each request sharing the response
+		cr.call.read = read
+	}
 	return err
 }
 
@@ -163,13 +320,41 @@ func (p *Proxy) handleLocalRequest(w http.ResponseWriter, r *http.Request) error
 <body>
 <h1>compy</h1>
 <ul>
-<li>total transcoded: %d -> %d (%3.1f%%)</li>
+<li>total transcoded: %d -> %d (%3.1f%%)</li>%s
+<li><a href="/transcoders">transcoders</a></li>
 <li><a href="/cacert">CA cert</a></li>
 <li><a href="https://github.com/barnacs/compy">GitHub</a></li>
-</ul>
+</ul>%s%s
 </body>
-</html>`, read, written, float64(written)/float64(read)*100))
+</html>`, read, written, float64(written)/float64(read)*100, p.blockingStats(), p.captureControls(r), p.placeholderControls(r)))
 		return nil
+	} else if r.Method == "GET" && r.URL.Path == "/transcoders" {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<html>
+<head>
+<title>compy transcoders</title>
+</head>
+<body>
+<h1>transcoders</h1>
+<table>
+<tr><th>content type</th><th>priority</th><th>transcoder</th></tr>
+`)
+		for _, t := range p.Transcoders() {
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td><td>%s</td></tr>\n",
+				html.EscapeString(t.Pattern), t.Priority, html.EscapeString(t.Description))
+		}
+		io.WriteString(w, `</table>
+</body>
+</html>`)
+		return nil
+	} else if r.Method == "POST" && !p.authorized(r) {
+		// settings only change with the credentials on the request itself
+		p.requireAuth(w)
+		return nil
+	} else if r.Method == "POST" && r.URL.Path == "/capture" {
+		return p.handleCapture(w, r)
+	} else if r.Method == "POST" && r.URL.Path == "/placeholders" {
+		return p.handlePlaceholders(w, r)
 	} else if r.Method == "GET" && r.URL.Path == "/cacert" {
 		if p.cert == "" {
 			http.NotFound(w, r)
@@ -184,6 +369,61 @@ func (p *Proxy) handleLocalRequest(w http.ResponseWriter, r *http.Request) error
 	}
 }
 
+func (p *Proxy) captureControls(r *http.Request) string {
+	if p.capture == nil {
+		return ""
+	}
+	global, own := p.capture.capturing(clientHost(r))
+	button := func(scope string, on bool) string {
+		action := "start"
+		if on {
+			action = "stop"
+		}
+		return fmt.Sprintf(`<form method="post" action="/capture">
+<input type="hidden" name="scope" value="%s">
+<input type="submit" name="action" value="%s">
+</form>`, scope, action)
+	}
+	return fmt.Sprintf(`
+<h2>HAR capture</h2>
+<ul>
+<li>all clients: %t %s</li>
+<li>this client (%s): %t %s</li>
+</ul>`, global, button("global", global), clientHost(r), own, button("client", own))
+}
+
+func (p *Proxy) handleCapture(w http.ResponseWriter, r *http.Request) error {
+	if p.capture == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	client := ""
+	switch r.FormValue("scope") {
+	case "global":
+	case "client":
+		client = clientHost(r)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	var err error
+	switch r.FormValue("action") {
+	case "start":
+		err = p.capture.start(client)
+	case "stop":
+		err = p.capture.stop(client)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return fmt.Errorf("HAR capture: %s", err)
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
 func forward(r *http.Request) (*http.Response, error) {
 	if r.URL.Scheme == "" {
 		if r.TLS != nil && r.TLS.ServerName == r.Host {
@@ -199,11 +439,29 @@ func forward(r *http.Request) (*http.Response, error) {
 	return http.DefaultTransport.RoundTrip(r)
 }
 
+// TranscodeResponse runs resp through the registered transcoders as if it
+// was proxied in reply to a request with the given headers, writing the
+// result to w. It returns the number of body bytes read and written.
+func (p *Proxy) TranscodeResponse(w http.ResponseWriter, resp *http.Response, headers http.Header) (read, written uint64, err error) {
+	rw := newResponseWriter(w)
+	rr := newResponseReader(resp)
+	err = p.proxyResponse(rw, rr, headers)
+	rw.flushHeaders()
+	return rr.counter.Count(), rw.rw.Count(), err
+}
+
 func (p *Proxy) proxyResponse(w *ResponseWriter, r *ResponseReader, headers http.Header) error {
+	w.variant = p.variant(headers)
 	w.takeHeaders(r)
-	transcoder, found := p.transcoders[r.ContentType()]
+	transcoder, found := p.transcoders.lookup(r.Header().Get("Content-Type"))
+	if !transcodable(r, headers) {
+		found = false
+	} else if p.sniff {
+		transcoder, found = p.sniffTranscoder(w, r)
+	}
 	if !found {
-		return w.ReadFrom(r)
+		_, err := w.ReadFrom(r)
+		return err
 	}
 	w.setChunked()
 	if err := transcoder.Transcode(w, r, headers); err != nil {
@@ -212,6 +470,58 @@ func (p *Proxy) proxyResponse(w *ResponseWriter, r *ResponseReader, headers http
 	return nil
 }
 
+// transcodesPartial tells whether resp is part of a body that would be
+// transcoded.
+func (p *Proxy) transcodesPartial(r *http.Request, resp *http.Response) bool {
+	if r.Method != "GET" || resp.StatusCode != http.StatusPartialContent || noTransform(resp.Header) || noTransform(r.Header) {
+		return false
+	}
+	_, found := p.transcoders.lookup(resp.Header.Get("Content-Type"))
+	return found
+}
+
+// transcodable tells whether the body of a response may be transcoded:
+// there is a whole one, and neither the request nor the response forbid
+// changing it.
+func transcodable(r *ResponseReader, headers http.Header) bool {
+	switch r.r.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	if req := r.Request(); req != nil && req.Method == "HEAD" {
+		return false
+	}
+	return !noTransform(r.Header()) && !noTransform(headers)
+}
+
+// noTransform tells whether the Cache-Control header of a request or
+// response forbids changing the body (RFC 9111, section 5.2).
+func noTransform(h http.Header) bool {
+	return hasDirective(h, "Cache-Control", "no-transform")
+}
+
+func (p *Proxy) sniffTranscoder(w *ResponseWriter, r *ResponseReader) (Transcoder, bool) {
+	declared := r.ContentType()
+	if ce := r.Header().Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return p.transcoders.lookup(r.Header().Get("Content-Type"))
+	}
+	b, _ := r.Peek(sniffLen)
+	nosniff := strings.EqualFold(r.Header().Get("X-Content-Type-Options"), "nosniff")
+	contentType, ok := sniff(b, declared, nosniff)
+	if !ok {
+		return nil, false
+	}
+	if contentType != declared {
+		log.Printf("sniffed %s as %s", r.Request().URL, contentType)
+		// the declared type is restored unless the transcoder changes the
+		// body
+		w.relabelled, w.declaredType = true, r.Header().Get("Content-Type")
+		r.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Type", contentType)
+	}
+	return p.transcoders.lookup(r.Header().Get("Content-Type"))
+}
+
 func (p *Proxy) handleConnect(w http.ResponseWriter, r *http.Request) error {
 	if p.ml == nil {
 		return fmt.Errorf("CONNECT received but mitm is not enabled")
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// registry selects transcoders by media type patterns. A pattern is either
+// an exact media type, optionally with parameters that must be present on
+// the response ("text/html; charset=utf-8"), a wildcard ("image/*",
+// "*/*"), or a structured syntax suffix ("+json", "application/*+xml").
+// Among the matching patterns the highest priority wins, then the most
+// specific one, then the one registered last.
+type registry struct {
+	mu       sync.RWMutex
+	entries  []*registration
+	fallback Transcoder
+	order    int
+}
+
+type registration struct {
+	pattern    string
+	priority   int
+	transcoder Transcoder
+
+	typ     string
+	subtype string
+	suffix  string
+	params  map[string]string
+	order   int
+}
+
+// TranscoderInfo describes a registered transcoder.
+type TranscoderInfo struct {
+	Pattern     string
+	Priority    int
+	Transcoder  Transcoder
+	Description string
+}
+
+func newRegistry() *registry {
+	return &registry{}
+}
+
+func parsePattern(pattern string) (*registration, error) {
+	p := strings.TrimSpace(pattern)
+	if strings.HasPrefix(p, "+") {
+		p = "*/*" + p
+	}
+	mediaType, params, err := mime.ParseMediaType(p)
+	if err != nil {
+		return nil, fmt.Errorf("invalid media type pattern %q: %s", pattern, err)
+	}
+	parts := strings.SplitN(mediaType, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid media type pattern %q", pattern)
+	}
+	r := &registration{
+		pattern: pattern,
+		typ:     parts[0],
+		subtype: parts[1],
+		params:  params,
+	}
+	if i := strings.LastIndex(r.subtype, "+"); i >= 0 {
+		r.suffix = r.subtype[i+1:]
+		r.subtype = r.subtype[:i]
+	}
+	if r.typ == "*" && r.subtype != "*" {
+		return nil, fmt.Errorf("invalid media type pattern %q", pattern)
+	}
+	return r, nil
+}
+
+// specificity ranks exact types over suffixes over wildcards, parameters
+// adding to any of these.
+func (r *registration) specificity() int {
+	s := len(r.params)
+	switch {
+	case r.subtype != "*":
+		s += 30
+	case r.suffix != "":
+		s += 20
+	case r.typ != "*":
+		s += 10
+	}
+	return s
+}
+
+func (r *registration) matches(typ, subtype string, params map[string]string) bool {
+	if r.typ != "*" && r.typ != typ {
+		return false
+	}
+	if r.subtype != "*" {
+		full := r.subtype
+		if r.suffix != "" {
+			full += "+" + r.suffix
+		}
+		if full != subtype {
+			return false
+		}
+	} else if r.suffix != "" && !strings.HasSuffix(subtype, "+"+r.suffix) {
+		return false
+	}
+	for k, v := range r.params {
+		if !strings.EqualFold(params[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+func (reg *registry) add(pattern string, priority int, t Transcoder) error {
+	r, err := parsePattern(pattern)
+	if err != nil {
+		return err
+	}
+	r.priority = priority
+	r.transcoder = t
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.order++
+	r.order = reg.order
+	for i, e := range reg.entries {
+		if e.pattern == pattern {
+			reg.entries[i] = r
+			return nil
+		}
+	}
+	reg.entries = append(reg.entries, r)
+	return nil
+}
+
+func (reg *registry) setFallback(t Transcoder) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.fallback = t
+}
+
+// lookup returns the transcoder for a Content-Type header value.
+func (reg *registry) lookup(contentType string) (Transcoder, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	var best *registration
+	if mediaType, params, err := mime.ParseMediaType(contentType); err == nil {
+		parts := strings.SplitN(mediaType, "/", 2)
+		if len(parts) == 2 {
+			for _, e := range reg.entries {
+				if !e.matches(parts[0], parts[1], params) {
+					continue
+				}
+				if best == nil || e.priority > best.priority ||
+					e.priority == best.priority && (e.specificity() > best.specificity() ||
+						e.specificity() == best.specificity() && e.order > best.order) {
+					best = e
+				}
+			}
+		}
+	}
+	if best != nil {
+		return best.transcoder, true
+	}
+	return reg.fallback, reg.fallback != nil
+}
+
+func (reg *registry) list() []TranscoderInfo {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	entries := append([]*registration{}, reg.entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].priority != entries[j].priority {
+			return entries[i].priority > entries[j].priority
+		}
+		return entries[i].specificity() > entries[j].specificity()
+	})
+	var infos []TranscoderInfo
+	for _, e := range entries {
+		infos = append(infos, TranscoderInfo{
+			Pattern:     e.pattern,
+			Priority:    e.priority,
+			Transcoder:  e.transcoder,
+			Description: describe(e.transcoder),
+		})
+	}
+	if reg.fallback != nil {
+		infos = append(infos, TranscoderInfo{
+			Pattern:     "(fallback)",
+			Transcoder:  reg.fallback,
+			Description: describe(reg.fallback),
+		})
+	}
+	return infos
+}
+
+func describe(t Transcoder) string {
+	if s, ok := t.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", t)
+}
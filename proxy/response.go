@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
 	"io"
 	"mime"
 	"net/http"
@@ -11,15 +13,20 @@ import (
 type ResponseReader struct {
 	io.Reader
 	counter *datacounter.ReaderCounter
-	r       *http.Response
+	// received yields the body as received, and peeked buffers it for
+	// Peek, to tell whether it was transformed
+	received io.Reader
+	peeked   *bufio.Reader
+	r        *http.Response
 }
 
 func newResponseReader(r *http.Response) *ResponseReader {
 	counter := datacounter.NewReaderCounter(r.Body)
 	return &ResponseReader{
-		Reader:  counter,
-		counter: counter,
-		r:       r,
+		Reader:   counter,
+		counter:  counter,
+		received: counter,
+		r:        r,
 	}
 }
 
@@ -29,6 +36,26 @@ func (r *ResponseReader) ContentType() string {
 	return ct
 }
 
+// Peek returns the next n bytes of the body without consuming them. Fewer
+// bytes are returned along with an error if the body is shorter.
+func (r *ResponseReader) Peek(n int) ([]byte, error) {
+	br, ok := r.Reader.(*bufio.Reader)
+	if !ok || br.Size() < n {
+		pristine := r.pristine()
+		br = bufio.NewReaderSize(r.Reader, n)
+		r.Reader = br
+		if pristine {
+			r.peeked = br
+		}
+	}
+	return br.Peek(n)
+}
+
+// pristine tells whether Reader still yields the body as received.
+func (r *ResponseReader) pristine() bool {
+	return r.Reader == r.received || r.peeked != nil && r.Reader == io.Reader(r.peeked)
+}
+
 func (r *ResponseReader) Header() http.Header {
 	return r.r.Header
 }
@@ -40,8 +67,20 @@ func (r *ResponseReader) Request() *http.Request {
 type ResponseWriter struct {
 	io.Writer
 	rw          *datacounter.ResponseWriterCounter
+	sent        io.Writer
 	statusCode  int
 	headersDone bool
+	// via is added to the Via header of proxied responses
+	via string
+	// transformed is set once the body or its type differ from the
+	// response received, sent being the Writer taking the body as is
+	transformed bool
+	// variant goes into the ETag of a transformed body, see Proxy.variant
+	variant string
+	// relabelled is set when the body was sniffed as another type than
+	// declaredType, which is sent unless the body is transformed
+	relabelled   bool
+	declaredType string
 }
 
 func newResponseWriter(w http.ResponseWriter) *ResponseWriter {
@@ -49,15 +88,26 @@ func newResponseWriter(w http.ResponseWriter) *ResponseWriter {
 	return &ResponseWriter{
 		Writer: rw,
 		rw:     rw,
+		sent:   rw,
 	}
 }
 
+// takeHeaders copies the headers of r, whose body as it is now is the
+// one received.
 func (w *ResponseWriter) takeHeaders(r *ResponseReader) {
+	r.received, r.peeked, w.sent = r.Reader, nil, w.Writer
 	for k, v := range r.Header() {
 		for _, v := range v {
 			w.Header().Add(k, v)
 		}
 	}
+	if _, ok := r.Header()["Content-Type"]; !ok {
+		// nor may net/http sniff one, e.g. text/html for an upload
+		w.Header()["Content-Type"] = nil
+	}
+	if w.via != "" {
+		w.Header().Add("Via", w.via)
+	}
 	w.WriteHeader(r.r.StatusCode)
 }
 
@@ -69,13 +119,16 @@ func (w *ResponseWriter) WriteHeader(s int) {
 	w.statusCode = s
 }
 
-func (w *ResponseWriter) ReadFrom(r io.Reader) error {
+func (w *ResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rr, ok := r.(*ResponseReader); !ok || !rr.pristine() || w.Writer != w.sent {
+		w.transformed = true
+	}
 	w.flushHeaders()
-	_, err := io.Copy(w.Writer, r)
-	return err
+	return io.Copy(w.Writer, r)
 }
 
 func (w *ResponseWriter) Write(b []byte) (int, error) {
+	w.transformed = true
 	w.flushHeaders()
 	return w.Writer.Write(b)
 }
@@ -84,6 +137,28 @@ func (w *ResponseWriter) flushHeaders() {
 	if w.headersDone {
 		return
 	}
+	if w.relabelled && !w.transformed {
+		if w.declaredType == "" {
+			w.Header()["Content-Type"] = nil
+		} else {
+			w.Header().Set("Content-Type", w.declaredType)
+		}
+	}
+	if w.transformed {
+		w.Header().Add("Warning", `214 compy "Transformation applied"`)
+		// ranges of the original body don't apply
+		w.Header().Set("Accept-Ranges", "none")
+		for _, h := range digestHeaders {
+			w.Header().Del(h)
+		}
+		if etag := w.Header().Get("ETag"); etag != "" {
+			if variant, ok := variantETag(etag, w.Header(), w.variant); ok {
+				w.Header().Set("ETag", variant)
+			} else {
+				w.Header().Del("ETag")
+			}
+		}
+	}
 	w.rw.WriteHeader(w.statusCode)
 	w.headersDone = true
 }
@@ -91,3 +166,26 @@ func (w *ResponseWriter) flushHeaders() {
 func (w *ResponseWriter) setChunked() {
 	w.Header().Del("Content-Length")
 }
+
+// ResponseBuffer is an http.ResponseWriter keeping the response in memory,
+// for transcoding bodies outside of a proxied request.
+type ResponseBuffer struct {
+	bytes.Buffer
+	StatusCode int
+	header     http.Header
+}
+
+func NewResponseBuffer() *ResponseBuffer {
+	return &ResponseBuffer{
+		StatusCode: http.StatusOK,
+		header:     make(http.Header),
+	}
+}
+
+func (b *ResponseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *ResponseBuffer) WriteHeader(s int) {
+	b.StatusCode = s
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// sniffLen is the number of leading body bytes looked at when sniffing.
+const sniffLen = 512
+
+// genericTypes are declared content types that say nothing useful about
+// the body, so sniffing may replace them.
+var genericTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"application/unknown":      true,
+	"unknown/unknown":          true,
+	"application/x-unknown":    true,
+}
+
+var signatures = []struct {
+	prefix      []byte
+	contentType string
+}{
+	{[]byte("\xFF\xD8\xFF"), "image/jpeg"},
+	{[]byte("\x89PNG\r\n\x1A\n"), "image/png"},
+	{[]byte("GIF87a"), "image/gif"},
+	{[]byte("GIF89a"), "image/gif"},
+}
+
+// sniffBinary recognizes image formats by their magic numbers.
+func sniffBinary(b []byte) string {
+	for _, sig := range signatures {
+		if bytes.HasPrefix(b, sig.prefix) {
+			return sig.contentType
+		}
+	}
+	if len(b) >= 12 && bytes.Equal(b[:4], []byte("RIFF")) && bytes.Equal(b[8:12], []byte("WEBP")) {
+		return "image/webp"
+	}
+	return ""
+}
+
+var jsPrefixes = []string{
+	"(function", "!function", ";(function", "function", "var ", "let ", "const ",
+	"\"use strict\"", "'use strict'", "import ", "export ", "window.", "document.",
+	"self.", "this.", "if(", "if (", "try{", "try {",
+}
+
+var cssPrefixes = []string{
+	"@charset", "@import", "@media", "@font-face", "@keyframes", "@supports",
+	":root", "html{", "html {", "body{", "body {", "*{", "* {",
+}
+
+// sniffText guesses the type of textual content using simple heuristics.
+// It returns an empty string if b doesn't look like text or is ambiguous.
+// Markup is never recognized: transcoding an upload as HTML or SVG would
+// rewrite a download into a document, and one running scripts on the
+// origin if it were labelled as such.
+func sniffText(b []byte) string {
+	if !looksLikeText(b) {
+		return ""
+	}
+	t := bytes.TrimPrefix(b, []byte("\xEF\xBB\xBF"))
+	t = skipComments(bytes.TrimSpace(t))
+	lower := strings.ToLower(string(t))
+
+	if strings.HasPrefix(lower, "{") || strings.HasPrefix(lower, "[") {
+		if looksLikeJSON(t) {
+			return "application/json"
+		}
+	}
+	for _, prefix := range cssPrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return "text/css"
+		}
+	}
+	for _, prefix := range jsPrefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return "application/javascript"
+		}
+	}
+	return ""
+}
+
+// looksLikeJSON reports whether b is a valid, possibly truncated, JSON
+// document.
+func looksLikeJSON(b []byte) bool {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		_, err := dec.Token()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return true
+		}
+		if err != nil {
+			// running out of input in the middle of a token surfaces as a
+			// syntax error at the very end
+			if serr, ok := err.(*json.SyntaxError); ok && serr.Offset >= int64(len(b)) {
+				return true
+			}
+			return false
+		}
+	}
+}
+
+func looksLikeText(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	// allow a multi-byte rune cut off at the end of the sniffed prefix
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size <= 1 {
+			return len(b) < utf8.UTFMax
+		}
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != '\f' {
+			return false
+		}
+		b = b[size:]
+	}
+	return true
+}
+
+// skipComments drops leading /* */ and // comments shared by CSS and
+// JavaScript so the prefix checks see the first statement.
+func skipComments(b []byte) []byte {
+	for {
+		switch {
+		case bytes.HasPrefix(b, []byte("/*")):
+			end := bytes.Index(b[2:], []byte("*/"))
+			if end < 0 {
+				return nil
+			}
+			b = bytes.TrimSpace(b[end+4:])
+		case bytes.HasPrefix(b, []byte("//")):
+			end := bytes.IndexByte(b, '\n')
+			if end < 0 {
+				return nil
+			}
+			b = bytes.TrimSpace(b[end+1:])
+		default:
+			return b
+		}
+	}
+}
+
+// sniff determines the content type of a response body from its first
+// bytes and the declared type. It returns the type to transcode the
+// response as, and false if the body contradicts the declared type and
+// should be passed through untouched instead.
+func sniff(b []byte, declared string, nosniff bool) (string, bool) {
+	sniffed := sniffBinary(b)
+	if sniffed == "" && genericTypes[declared] {
+		sniffed = sniffText(b)
+	}
+
+	switch {
+	case sniffed == "" && hasSignature(declared) && len(b) > 0:
+		// e.g. an HTML error page labelled as an image
+		return declared, false
+	case sniffed == "" || sniffed == declared:
+		return declared, true
+	case nosniff:
+		return declared, genericTypes[declared]
+	}
+	return sniffed, true
+}
+
+func hasSignature(contentType string) bool {
+	for _, sig := range signatures {
+		if sig.contentType == contentType {
+			return true
+		}
+	}
+	return contentType == "image/webp"
+}
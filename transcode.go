@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/barnacs/compy/proxy"
+)
+
+// transcodeCommand runs the configured transcoders over local files, as
+// if they were served to a client sending the given headers.
+func transcodeCommand(args []string) int {
+	fs := flag.NewFlagSet("transcode", flag.ExitOnError)
+	accept := fs.String("accept", "*/*", "Accept header to transcode for")
+	acceptEncoding := fs.String("accept-encoding", "", "Accept-Encoding header to transcode for")
+	quality := fs.String("quality", "", proxy.QualityHeader+" header to transcode for")
+	out := fs.String("out", "", "directory to write transcoded files to")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: compy [flags] transcode [options] <file or directory>...\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	headers := make(http.Header)
+	headers.Set("Accept", *accept)
+	if *acceptEncoding != "" {
+		headers.Set("Accept-Encoding", *acceptEncoding)
+	}
+	if *quality != "" {
+		headers.Set(proxy.QualityHeader, *quality)
+	}
+
+	p := proxy.New(*host, *cert)
+	addTranscoders(p)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "file\ttype\tin\tout\tsize\ttime\t")
+	var totalRead, totalWritten uint64
+	status := 0
+	for _, root := range fs.Args() {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil || rel == "." {
+				rel = filepath.Base(path)
+			}
+			res, err := transcodeFile(p, path, headers)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+				status = 1
+				return nil
+			}
+			totalRead += res.read
+			totalWritten += res.written
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%3.1f%%\t%s\t\n", path, res.contentType,
+				res.read, res.written, percent(res.written, res.read), res.elapsed.Round(time.Microsecond))
+			if *out != "" {
+				return writeOutput(filepath.Join(*out, rel), res)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	fmt.Fprintf(tw, "total\t\t%d\t%d\t%3.1f%%\t\t\n", totalRead, totalWritten, percent(totalWritten, totalRead))
+	tw.Flush()
+	return status
+}
+
+type transcodeResult struct {
+	contentType string
+	read        uint64
+	written     uint64
+	elapsed     time.Duration
+	buf         *proxy.ResponseBuffer
+}
+
+func transcodeFile(p *proxy.Proxy, path string, headers http.Header) (*transcodeResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	resp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          f,
+		ContentLength: info.Size(),
+		Request: &http.Request{
+			Method: "GET",
+			URL:    &url.URL{Scheme: "file", Path: filepath.ToSlash(path)},
+			Header: headers,
+		},
+	}
+	if contentType != "" {
+		resp.Header.Set("Content-Type", contentType)
+	}
+
+	buf := proxy.NewResponseBuffer()
+	start := time.Now()
+	read, written, err := p.TranscodeResponse(buf, resp, headers)
+	if err != nil {
+		return nil, err
+	}
+	return &transcodeResult{
+		contentType: contentType,
+		read:        read,
+		written:     written,
+		elapsed:     time.Since(start),
+		buf:         buf,
+	}, nil
+}
+
+// outputExtensions maps transcoded content types and encodings to the
+// file extension the output is written with.
+var outputExtensions = map[string]string{
+	"image/webp": ".webp",
+	"image/avif": ".avif",
+	"zstd":       ".zst",
+	"br":         ".br",
+	"gzip":       ".gz",
+}
+
+func writeOutput(path string, res *transcodeResult) error {
+	header := res.buf.Header()
+	original, _, _ := mime.ParseMediaType(res.contentType)
+	if ct, _, _ := mime.ParseMediaType(header.Get("Content-Type")); ct != "" && ct != original {
+		if ext, ok := outputExtensions[ct]; ok {
+			path = strings.TrimSuffix(path, filepath.Ext(path)) + ext
+		}
+	}
+	if ext, ok := outputExtensions[header.Get("Content-Encoding")]; ok {
+		path += ext
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, res.buf.Bytes(), 0644)
+}
+
+// percent returns written as a percentage of read, 0 if nothing was read,
+// e.g. when every entry of a HAR file was skipped.
+func percent(written, read uint64) float64 {
+	if read == 0 {
+		return 0
+	}
+	return float64(written) / float64(read) * 100
+}
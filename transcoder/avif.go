@@ -0,0 +1,80 @@
+package transcoder
+
+import (
+	"net/http"
+)
+
+// Avif holds the AVIF encoder settings shared by the image transcoders.
+// Encoding AVIF is much more expensive than WebP, so only a limited number
+// of images are encoded at a time; clients get WebP while the budget is
+// used up. AVIF encoding requires a build with the avif tag, see
+// AvifSupported.
+type Avif struct {
+	// Quality is 1-100, like JPEG quality.
+	Quality int
+	// Speed is the encoder speed, 0 (slowest, smallest) - 10 (fastest).
+	Speed int
+	jobs  chan struct{}
+}
+
+// NewAvif returns AVIF settings allowing at most jobs concurrent encodes.
+func NewAvif(quality, speed, jobs int) *Avif {
+	if jobs < 1 {
+		jobs = 1
+	}
+	return &Avif{
+		Quality: quality,
+		Speed:   speed,
+		jobs:    make(chan struct{}, jobs),
+	}
+}
+
+func (a *Avif) enabled() bool {
+	return AvifSupported && a != nil && a.Quality > 0
+}
+
+// acquire reserves one encode from the budget without waiting.
+func (a *Avif) acquire() bool {
+	select {
+	case a.jobs <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (a *Avif) release() {
+	<-a.jobs
+}
+
+// negotiate picks the format to send an image in, see imageFormat, and
+// reserves an AVIF encode from the budget, settling for WebP when it's used
+// up. release must be called once the image is encoded.
+func (a *Avif) negotiate(headers http.Header, original string, webp bool) (format string, release func()) {
+	format = imageFormat(headers, original, a.enabled(), webp)
+	if format != "image/avif" {
+		return format, func() {}
+	}
+	if !a.acquire() {
+		// out of budget, settle for WebP
+		return imageFormat(headers, original, false, webp), func() {}
+	}
+	return format, a.release
+}
+
+// imageFormat picks the format to send an image in: whichever of AVIF and
+// WebP (if enabled) the client lists explicitly with the higher weight,
+// preferring AVIF on ties, or else the original format.
+func imageFormat(headers http.Header, original string, avif, webp bool) string {
+	var offers []string
+	if avif {
+		offers = append(offers, "image/avif")
+	}
+	if webp {
+		offers = append(offers, "image/webp")
+	}
+	if format := ParseAccept(headers.Get("Accept")).NegotiateExplicit(offers...); format != "" {
+		return format
+	}
+	return original
+}
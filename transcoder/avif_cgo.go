@@ -0,0 +1,77 @@
+//go:build avif && cgo && !purego
+// +build avif,cgo,!purego
+
+package transcoder
+
+/*
+#cgo LDFLAGS: -lavif
+#include <stdlib.h>
+#include <avif/avif.h>
+
+static avifResult compyEncodeAvif(uint8_t *pixels, uint32_t width, uint32_t height,
+		uint32_t rowBytes, int opaque, int quantizer, int speed, avifRWData *output) {
+	avifResult result;
+	avifImage *image = avifImageCreate(width, height, 8, AVIF_PIXEL_FORMAT_YUV420);
+	avifRGBImage rgb;
+	avifRGBImageSetDefaults(&rgb, image);
+	rgb.format = AVIF_RGB_FORMAT_RGBA;
+	rgb.depth = 8;
+	rgb.ignoreAlpha = opaque ? AVIF_TRUE : AVIF_FALSE;
+	rgb.pixels = pixels;
+	rgb.rowBytes = rowBytes;
+	result = avifImageRGBToYUV(image, &rgb);
+	if (result == AVIF_RESULT_OK) {
+		avifEncoder *encoder = avifEncoderCreate();
+		encoder->maxThreads = 1;
+		encoder->speed = speed;
+		encoder->minQuantizer = quantizer;
+		encoder->maxQuantizer = quantizer;
+		encoder->minQuantizerAlpha = quantizer;
+		encoder->maxQuantizerAlpha = quantizer;
+		result = avifEncoderWrite(encoder, image, output);
+		avifEncoderDestroy(encoder);
+	}
+	avifImageDestroy(image);
+	return result;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"unsafe"
+)
+
+// AvifSupported tells whether compy was built with AVIF encoding, which
+// requires cgo, libavif and the avif build tag.
+const AvifSupported = true
+
+func encodeAvif(w io.Writer, img image.Image, quality, speed int) error {
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(img.Bounds())
+		draw.Draw(nrgba, nrgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	bounds := nrgba.Bounds()
+	pixels := C.CBytes(nrgba.Pix)
+	defer C.free(pixels)
+
+	// libavif quantizers go from 0 (lossless) to 63 (worst)
+	quantizer := (100 - quality) * C.AVIF_QUANTIZER_WORST_QUALITY / 100
+	opaque := 0
+	if nrgba.Opaque() {
+		opaque = 1
+	}
+	var output C.avifRWData
+	defer C.avifRWDataFree(&output)
+	result := C.compyEncodeAvif((*C.uint8_t)(pixels), C.uint32_t(bounds.Dx()), C.uint32_t(bounds.Dy()),
+		C.uint32_t(nrgba.Stride), C.int(opaque), C.int(quantizer), C.int(speed), &output)
+	if result != C.AVIF_RESULT_OK {
+		return fmt.Errorf("avif: %s", C.GoString(C.avifResultToString(result)))
+	}
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(output.data), C.int(output.size)))
+	return err
+}
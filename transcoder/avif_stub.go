@@ -0,0 +1,18 @@
+//go:build !avif || !cgo || purego
+// +build !avif !cgo purego
+
+package transcoder
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// AvifSupported tells whether compy was built with AVIF encoding, which
+// requires cgo, libavif and the avif build tag.
+const AvifSupported = false
+
+func encodeAvif(w io.Writer, img image.Image, quality, speed int) error {
+	return errors.New("AVIF encoding requires building with -tags avif")
+}
@@ -0,0 +1,27 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+package transcoder
+
+import (
+	"io"
+
+	brotlidec "gopkg.in/kothar/brotli-go.v0/dec"
+	brotlienc "gopkg.in/kothar/brotli-go.v0/enc"
+)
+
+// BrotliImplementation names the brotli library compy was built with.
+const BrotliImplementation = "cgo"
+
+func newBrotliReader(r io.Reader) io.ReadCloser {
+	return brotlidec.NewBrotliReader(r)
+}
+
+func newBrotliWriter(w io.Writer, quality, lgwin int) io.WriteCloser {
+	params := brotlienc.NewBrotliParams()
+	params.SetQuality(quality)
+	if lgwin != 0 {
+		params.SetLgwin(lgwin)
+	}
+	return brotlienc.NewBrotliWriter(params, w)
+}
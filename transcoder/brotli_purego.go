@@ -0,0 +1,25 @@
+//go:build !cgo || purego
+// +build !cgo purego
+
+package transcoder
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/andybalholm/brotli"
+)
+
+// BrotliImplementation names the brotli library compy was built with.
+const BrotliImplementation = "purego"
+
+func newBrotliReader(r io.Reader) io.ReadCloser {
+	return ioutil.NopCloser(brotli.NewReader(r))
+}
+
+func newBrotliWriter(w io.Writer, quality, lgwin int) io.WriteCloser {
+	return brotli.NewWriterOptions(w, brotli.WriterOptions{
+		Quality: quality,
+		LGWin:   lgwin,
+	})
+}
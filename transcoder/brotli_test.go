@@ -0,0 +1,95 @@
+//go:build cgo
+// +build cgo
+
+package transcoder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	brotlidec "gopkg.in/kothar/brotli-go.v0/dec"
+	brotlienc "gopkg.in/kothar/brotli-go.v0/enc"
+)
+
+// Compare the cgo and pure Go brotli encoders at the same settings:
+// go test -bench Brotli ./transcoder
+
+func benchmarkInput() []byte {
+	var b bytes.Buffer
+	b.WriteString("<!DOCTYPE html><html><head><title>benchmark</title></head><body>\n")
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&b, "<div class=\"item item-%d\"><a href=\"/articles/%d\">Article %d</a><p>Lorem ipsum dolor sit amet, consectetur adipiscing elit %d.</p></div>\n", i%7, i, i, i*31%97)
+	}
+	b.WriteString("</body></html>\n")
+	return b.Bytes()
+}
+
+func benchmarkBrotli(b *testing.B, newWriter func(io.Writer, int, int) io.WriteCloser) {
+	input := benchmarkInput()
+	for _, quality := range []int{1, 6, 11} {
+		for _, lgwin := range []int{16, 22} {
+			b.Run(fmt.Sprintf("q%d/lgwin%d", quality, lgwin), func(b *testing.B) {
+				var out bytes.Buffer
+				b.SetBytes(int64(len(input)))
+				for i := 0; i < b.N; i++ {
+					out.Reset()
+					w := newWriter(&out, quality, lgwin)
+					if _, err := w.Write(input); err != nil {
+						b.Fatal(err)
+					}
+					if err := w.Close(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(out.Len())/float64(len(input))*100, "%size")
+			})
+		}
+	}
+}
+
+func BenchmarkBrotliCgo(b *testing.B) {
+	benchmarkBrotli(b, func(w io.Writer, quality, lgwin int) io.WriteCloser {
+		params := brotlienc.NewBrotliParams()
+		params.SetQuality(quality)
+		params.SetLgwin(lgwin)
+		return brotlienc.NewBrotliWriter(params, w)
+	})
+}
+
+func BenchmarkBrotliPureGo(b *testing.B) {
+	benchmarkBrotli(b, func(w io.Writer, quality, lgwin int) io.WriteCloser {
+		return brotli.NewWriterOptions(w, brotli.WriterOptions{Quality: quality, LGWin: lgwin})
+	})
+}
+
+func BenchmarkBrotliDecodeCgo(b *testing.B) {
+	benchmarkBrotliDecode(b, func(r io.Reader) io.Reader {
+		return brotlidec.NewBrotliReader(r)
+	})
+}
+
+func BenchmarkBrotliDecodePureGo(b *testing.B) {
+	benchmarkBrotliDecode(b, func(r io.Reader) io.Reader {
+		return brotli.NewReader(r)
+	})
+}
+
+func benchmarkBrotliDecode(b *testing.B, newReader func(io.Reader) io.Reader) {
+	input := benchmarkInput()
+	var compressed bytes.Buffer
+	w := brotli.NewWriterLevel(&compressed, 6)
+	w.Write(input)
+	w.Close()
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n, err := io.Copy(ioutil.Discard, newReader(bytes.NewReader(compressed.Bytes())))
+		if err != nil || n != int64(len(input)) {
+			b.Fatal(n, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+package transcoder
+
+import (
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/chai2010/webp"
+	"github.com/pixiv/go-libjpeg/jpeg"
+)
+
+// ImageImplementation names the image libraries compy was built with.
+const ImageImplementation = "cgo"
+
+// LossyWebP tells whether lossy WebP encoding is available. Without it,
+// JPEG images are never transcoded to WebP.
+const LossyWebP = true
+
+func decodeJpeg(r io.Reader) (image.Image, error) {
+	return jpeg.Decode(r, &jpeg.DecoderOptions{})
+}
+
+// subsamplingRatios are the chroma subsampling options. go-libjpeg keeps
+// the subsampling of YCbCr images, so images are converted to the chosen one.
+var subsamplingRatios = map[string]image.YCbCrSubsampleRatio{
+	"444": image.YCbCrSubsampleRatio444,
+	"422": image.YCbCrSubsampleRatio422,
+	"420": image.YCbCrSubsampleRatio420,
+}
+
+func encodeJpeg(w io.Writer, img image.Image, options jpegOptions) error {
+	if ratio, ok := subsamplingRatios[options.subsampling]; ok {
+		if _, gray := img.(*image.Gray); !gray {
+			img = toYCbCr(img, ratio)
+		}
+	}
+	switch img.(type) {
+	case *image.YCbCr, *image.Gray, *image.RGBA:
+	default:
+		// libjpeg only takes these, e.g. normalized images are NRGBA
+		img = toRGBA(img)
+	}
+	return jpeg.Encode(w, img, &jpeg.EncoderOptions{
+		Quality:         options.quality,
+		OptimizeCoding:  true,
+		ProgressiveMode: options.progressive,
+	})
+}
+
+// toYCbCr converts img to the given chroma subsampling, averaging the
+// chroma of the pixels sharing a sample.
+func toYCbCr(img image.Image, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	if ycbcr, ok := img.(*image.YCbCr); ok && ycbcr.SubsampleRatio == ratio {
+		return ycbcr
+	}
+	bounds := img.Bounds()
+	dst := image.NewYCbCr(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), ratio)
+	cb := make([]int, len(dst.Cb))
+	cr := make([]int, len(dst.Cr))
+	counts := make([]int, len(dst.Cb))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			yy, u, v := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			dst.Y[dst.YOffset(x, y)] = yy
+			c := dst.COffset(x, y)
+			cb[c] += int(u)
+			cr[c] += int(v)
+			counts[c]++
+		}
+	}
+	for i, n := range counts {
+		if n > 0 {
+			dst.Cb[i] = uint8((cb[i] + n/2) / n)
+			dst.Cr[i] = uint8((cr[i] + n/2) / n)
+		}
+	}
+	return dst
+}
+
+func encodeWebP(w io.Writer, img image.Image, lossless bool, quality int) error {
+	return webp.Encode(w, img, &webp.Options{
+		Lossless: lossless,
+		Quality:  float32(quality),
+	})
+}
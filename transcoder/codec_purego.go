@@ -0,0 +1,46 @@
+//go:build !cgo || purego
+// +build !cgo purego
+
+package transcoder
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// ImageImplementation names the image libraries compy was built with.
+const ImageImplementation = "purego"
+
+// LossyWebP tells whether lossy WebP encoding is available. Without it,
+// JPEG images are never transcoded to WebP.
+const LossyWebP = false
+
+func decodeJpeg(r io.Reader) (image.Image, error) {
+	return jpeg.Decode(r)
+}
+
+// encodeJpeg uses the standard library encoder, which always uses 4:2:0
+// chroma subsampling and standard Huffman tables, so its output is larger
+// than libjpeg's at the same quality. It can't encode progressive images
+// either.
+func encodeJpeg(w io.Writer, img image.Image, options jpegOptions) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: options.quality})
+}
+
+func encodeWebP(w io.Writer, img image.Image, lossless bool, quality int) error {
+	if !lossless {
+		return errors.New("lossy WebP encoding requires cgo")
+	}
+	// the color indexed encoding of paletted images isn't always decodable
+	if _, ok := img.(*image.Paletted); ok {
+		nrgba := image.NewNRGBA(img.Bounds())
+		draw.Draw(nrgba, nrgba.Bounds(), img, img.Bounds().Min, draw.Src)
+		img = nrgba
+	}
+	return nativewebp.Encode(w, img, nil)
+}
@@ -0,0 +1,305 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/barnacs/compy/proxy"
+	"golang.org/x/net/publicsuffix"
+)
+
+// dataURITypes are the embedded image types DataURIs transcodes.
+var dataURITypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// DataURIs transcodes base64 images embedded in HTML and CSS as data:
+// URIs with the image transcoders of Images, keeping the result if it is
+// smaller. Like the HTML transcoders it goes inside Zip.
+type DataURIs struct {
+	proxy.Transcoder
+	Images *proxy.Proxy
+	// MaxSize is the largest embedded image transcoded, in bytes of
+	// base64, 0 for no limit.
+	MaxSize int
+	// Integrity lists the stylesheets pages check the integrity of, which
+	// are left alone.
+	Integrity *IntegrityURLs
+}
+
+func (t *DataURIs) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
+	switch r.ContentType() {
+	case "text/html", "application/xhtml+xml", "text/css":
+	default:
+		return t.Transcoder.Transcode(w, r, headers)
+	}
+	if r.Header().Get("Content-Encoding") != "" {
+		return t.Transcoder.Transcode(w, r, headers)
+	}
+	if req := r.Request(); req != nil && t.Integrity.Contains(req.URL.String()) {
+		return t.Transcoder.Transcode(w, r, headers)
+	}
+	// the embedded images are negotiated like the others
+	addVary(w.Header(), "Accept")
+	pr, pw := io.Pipe()
+	go func(src io.Reader) {
+		pw.CloseWithError(t.rewrite(pw, src, r.Request(), headers))
+	}(r.Reader)
+	defer pr.Close()
+	r.Reader = pr
+	return t.Transcoder.Transcode(w, r, headers)
+}
+
+func (t *DataURIs) rewrite(w io.Writer, r io.Reader, req *http.Request, headers http.Header) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+	bw := bufio.NewWriter(w)
+	for {
+		chunk, err := br.ReadSlice('d')
+		bw.Write(chunk)
+		switch err {
+		case nil:
+			if err := t.dataURI(bw, br, req, headers); err != nil {
+				return err
+			}
+		case bufio.ErrBufferFull:
+		case io.EOF:
+			return bw.Flush()
+		default:
+			return err
+		}
+	}
+}
+
+// dataURI transcodes the data: URI following a "d" just written, if there
+// is one. Anything else is left to be copied.
+func (t *DataURIs) dataURI(w *bufio.Writer, r *bufio.Reader, req *http.Request, headers http.Header) error {
+	const prefix = "ata:image/"
+	peek, _ := r.Peek(64)
+	if !bytes.HasPrefix(bytes.ToLower(peek), []byte(prefix)) {
+		return nil
+	}
+	comma := bytes.IndexByte(peek, ',')
+	if comma < 0 {
+		return nil
+	}
+	params := strings.Split(strings.ToLower(string(peek[len("ata:"):comma])), ";")
+	if !dataURITypes[params[0]] || params[len(params)-1] != "base64" {
+		return nil
+	}
+	header := string(peek[:comma+1])
+	r.Discard(len(header))
+
+	var data []byte
+	for {
+		b, err := r.Peek(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !isBase64(b[0]) || t.MaxSize > 0 && len(data) > t.MaxSize {
+			break
+		}
+		data = append(data, b[0])
+		r.Discard(1)
+	}
+	if t.MaxSize <= 0 || len(data) <= t.MaxSize {
+		if contentType, out := t.transcode(req, headers, params[0], data); out != nil {
+			w.WriteString("ata:" + contentType + ";base64,")
+			w.Write(out)
+			return nil
+		}
+	}
+	w.WriteString(header)
+	w.Write(data)
+	return nil
+}
+
+// transcode returns a smaller base64 encoding of an embedded image, nil if
+// there is none.
+func (t *DataURIs) transcode(req *http.Request, headers http.Header, contentType string, encoded []byte) (string, []byte) {
+	data, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		if data, err = base64.RawStdEncoding.DecodeString(string(encoded)); err != nil {
+			return "", nil
+		}
+	}
+	contentType, data = transcodeEmbedded(t.Images, req, headers, contentType, data)
+	if data == nil || base64.StdEncoding.EncodedLen(len(data)) >= len(encoded) {
+		return "", nil
+	}
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+	base64.StdEncoding.Encode(out, data)
+	return contentType, out
+}
+
+func isBase64(c byte) bool {
+	return 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '+' || c == '/' || c == '='
+}
+
+// transcodeEmbedded runs an image embedded in a document of req through
+// the image transcoders of images, returning its new type and body, or a
+// nil body on failure. Placeholders can't be tapped inside a document, so
+// they are never asked for.
+func transcodeEmbedded(images *proxy.Proxy, req *http.Request, headers http.Header, contentType string, data []byte) (string, []byte) {
+	headers = headers.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	headers.Set(proxy.PlaceholderHeader, "off")
+	if req == nil {
+		req = &http.Request{Method: "GET", URL: &url.URL{Scheme: "data", Opaque: contentType}}
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {contentType}},
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}
+	buf := proxy.NewResponseBuffer()
+	if _, _, err := images.TranscodeResponse(buf, resp, headers); err != nil || buf.StatusCode != http.StatusOK {
+		return "", nil
+	}
+	return buf.Header().Get("Content-Type"), buf.Bytes()
+}
+
+// ImageInliner replaces references to small images in HTML documents by
+// data: URIs, saving a request each. Only public images of the same site as
+// the document are inlined, as they are fetched by compy without the
+// client's cookies and from compy's network rather than the client's.
+type ImageInliner struct {
+	Images *proxy.Proxy
+	// MaxSize is the largest image inlined, in bytes as fetched.
+	MaxSize int
+	// Timeout bounds the time spent fetching images for a document, which
+	// holds up the rest of the document.
+	Timeout time.Duration
+	// Client fetches the images, nil for one that only connects to public
+	// addresses.
+	Client *http.Client
+}
+
+// publicClient is the default client of ImageInliner. Pages could otherwise
+// point it at compy's own network, so the address is checked once resolved,
+// right before connecting, rather than by looking the name up beforehand.
+var publicClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:         dialPublic,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+func dialPublic(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("refusing to connect to non-public address %s", host)
+			}
+			return nil
+		},
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, not routed publicly.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() && !ip.IsUnspecified() && !sharedAddressSpace.Contains(ip) &&
+		!(ip.To4() != nil && ip.To4()[0] == 0)
+}
+
+// sameSite tells whether a and b have the same scheme and registrable
+// domain, or the same host if it has none, like an address.
+func sameSite(a, b *url.URL) bool {
+	if a.Scheme != b.Scheme {
+		return false
+	}
+	ha, hb := strings.ToLower(a.Hostname()), strings.ToLower(b.Hostname())
+	if ha == hb {
+		return true
+	}
+	da, err := publicsuffix.EffectiveTLDPlusOne(ha)
+	if err != nil {
+		return false
+	}
+	db, err := publicsuffix.EffectiveTLDPlusOne(hb)
+	return err == nil && da == db
+}
+
+// inline returns a data: URI for the image at u referenced by the page
+// requested with req and headers, "" if it can't be inlined before
+// deadline.
+func (t *ImageInliner) inline(u *url.URL, req *http.Request, headers http.Header, deadline time.Time) string {
+	timeout := time.Until(deadline)
+	if timeout <= 0 || u.Scheme != "http" && u.Scheme != "https" || req == nil || !sameSite(u, req.URL) {
+		return ""
+	}
+	get, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return ""
+	}
+	get.Header.Set("Accept", "image/*")
+	get.Header.Set("User-Agent", headers.Get("User-Agent"))
+	get.Header.Set("Referer", req.URL.String())
+	client := *publicClient
+	if t.Client != nil {
+		client = *t.Client
+	}
+	client.Timeout = timeout
+	client.CheckRedirect = func(next *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if !sameSite(next.URL, req.URL) {
+			return errors.New("cross-site redirect")
+		}
+		return nil
+	}
+	resp, err := client.Do(get)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	cacheControl := strings.ToLower(resp.Header.Get("Cache-Control"))
+	if resp.StatusCode != http.StatusOK || !dataURITypes[contentType] && contentType != "image/webp" ||
+		resp.Header.Get("Set-Cookie") != "" || strings.Contains(cacheControl, "private") ||
+		strings.Contains(cacheControl, "no-store") || resp.ContentLength > int64(t.MaxSize) {
+		return ""
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(t.MaxSize)+1))
+	if err != nil || len(data) > t.MaxSize {
+		return ""
+	}
+	if newType, out := transcodeEmbedded(t.Images, resp.Request, headers, contentType, data); out != nil && len(out) < len(data) {
+		contentType, data = newType, out
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
@@ -0,0 +1,398 @@
+package transcoder
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/barnacs/compy/proxy"
+)
+
+// maxFontSize bounds the decoded size of fonts, as WOFF tables are
+// decompressed in memory.
+const maxFontSize = 32 << 20
+
+// woff2Quality is the brotli quality of WOFF2 fonts. Fonts are cached for
+// long, but are still encoded for each client that hasn't cached them yet,
+// and qualities 10 and 11 take many times longer for a few percent less.
+const woff2Quality = 9
+
+var fontTypes = map[string]bool{
+	"font/ttf":                true,
+	"font/otf":                true,
+	"font/sfnt":               true,
+	"font/woff":               true,
+	"application/x-font-ttf":  true,
+	"application/x-font-otf":  true,
+	"application/font-sfnt":   true,
+	"application/font-woff":   true,
+	"application/x-font-woff": true,
+}
+
+// Font converts TrueType, OpenType and WOFF fonts to WOFF2 for clients
+// supporting it, and may subset them to Latin characters. Like SVG it
+// goes outside Zip, which compresses the fonts sent as they are.
+type Font struct {
+	proxy.Transcoder
+	WOFF2 bool
+	// LatinHosts are the hosts, "*.example.com" for a domain and its
+	// subdomains or "*" for all, whose fonts are subset to the Latin and
+	// Latin Extended ranges. Only TrueType outlines are subset; fonts with
+	// PostScript outlines and variable fonts are kept whole.
+	LatinHosts []string
+}
+
+func (t *Font) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
+	if !fontTypes[r.ContentType()] {
+		return t.Transcoder.Transcode(w, r, headers)
+	}
+	data, ok, err := readDecoded(r)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return t.Transcoder.Transcode(w, r, headers)
+	}
+	w.Header().Del("Content-Encoding")
+	r.Reader = bytes.NewReader(data)
+
+	f, err := parseFont(data)
+	if err != nil {
+		return t.Transcoder.Transcode(w, r, headers)
+	}
+	subset := t.subsets(r.Request()) && f.subsetLatin()
+	if t.WOFF2 {
+		addVary(w.Header(), "Accept")
+		addVary(w.Header(), "User-Agent")
+		if SupportsWOFF2(headers) {
+			if out, err := f.woff2(); err == nil && len(out) < len(data) {
+				w.Header().Set("Content-Type", "font/woff2")
+				_, err = w.Write(out)
+				return err
+			}
+		}
+	}
+	if subset && !f.woff {
+		r.Reader = bytes.NewReader(f.sfnt())
+	}
+	return t.Transcoder.Transcode(w, r, headers)
+}
+
+func (t *Font) subsets(req *http.Request) bool {
+	host := ""
+	if req != nil {
+		host = strings.ToLower(req.URL.Hostname())
+	}
+	for _, pattern := range t.LatinHosts {
+		if matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// woff2Browsers are the first versions of browsers supporting WOFF2. The
+// first matching entry decides, as user agents name the browsers they
+// claim compatibility with too. All iOS browsers use the system's engine.
+var woff2Browsers = []struct {
+	re      *regexp.Regexp
+	version int
+}{
+	{regexp.MustCompile(`(?:iPhone|CPU) OS (\d+)_`), 10},
+	{regexp.MustCompile(`Edge/(\d+)`), 14},
+	{regexp.MustCompile(`Firefox/(\d+)`), 39},
+	{regexp.MustCompile(`Chrome/(\d+)`), 36},
+	{regexp.MustCompile(`Version/(\d+)[.\d]* (?:Mobile/\S+ )?Safari/`), 12},
+}
+
+// SupportsWOFF2 reports whether the client takes WOFF2 fonts, as told by
+// an Accept header listing them or, as browsers mostly send "*/*" for
+// fonts, by its user agent.
+func SupportsWOFF2(headers http.Header) bool {
+	accept := ParseAccept(headers.Get("Accept"))
+	for _, contentType := range []string{"font/woff2", "application/font-woff2"} {
+		if q, explicit := accept.Quality(contentType); explicit {
+			return q > 0
+		}
+	}
+	ua := headers.Get("User-Agent")
+	for _, b := range woff2Browsers {
+		if m := b.re.FindStringSubmatch(ua); m != nil {
+			version, _ := strconv.Atoi(m[1])
+			return version >= b.version
+		}
+	}
+	return false
+}
+
+type sfntTable struct {
+	tag  string
+	data []byte
+}
+
+// sfntFont is a TrueType or OpenType font, decoded from WOFF if woff is
+// set.
+type sfntFont struct {
+	flavor uint32
+	tables []sfntTable
+	woff   bool
+}
+
+var errFontFormat = errors.New("unsupported font format")
+
+// parseFont parses a TrueType or OpenType font or a WOFF one. Font
+// collections and WOFF2 fonts aren't supported.
+func parseFont(data []byte) (*sfntFont, error) {
+	if len(data) < 12 {
+		return nil, errFontFormat
+	}
+	var f *sfntFont
+	var err error
+	switch string(data[:4]) {
+	case "\x00\x01\x00\x00", "OTTO", "true":
+		f, err = parseSfnt(data)
+	case "wOFF":
+		f, err = parseWOFF(data)
+	default:
+		return nil, errFontFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(f.tables, func(i, j int) bool { return f.tables[i].tag < f.tables[j].tag })
+	for i := 1; i < len(f.tables); i++ {
+		if f.tables[i].tag == f.tables[i-1].tag {
+			return nil, errFontFormat
+		}
+	}
+	return f, nil
+}
+
+func parseSfnt(data []byte) (*sfntFont, error) {
+	n := int(binary.BigEndian.Uint16(data[4:]))
+	if len(data) < 12+16*n {
+		return nil, errFontFormat
+	}
+	f := &sfntFont{flavor: binary.BigEndian.Uint32(data)}
+	for i := 0; i < n; i++ {
+		record := data[12+16*i:]
+		offset, length := binary.BigEndian.Uint32(record[8:]), binary.BigEndian.Uint32(record[12:])
+		if uint64(offset)+uint64(length) > uint64(len(data)) {
+			return nil, errFontFormat
+		}
+		f.tables = append(f.tables, sfntTable{string(record[:4]), data[offset : offset+length]})
+	}
+	return f, nil
+}
+
+func parseWOFF(data []byte) (*sfntFont, error) {
+	if len(data) < 44 {
+		return nil, errFontFormat
+	}
+	n := int(binary.BigEndian.Uint16(data[12:]))
+	if len(data) < 44+20*n {
+		return nil, errFontFormat
+	}
+	f := &sfntFont{flavor: binary.BigEndian.Uint32(data[4:]), woff: true}
+	size := 0
+	for i := 0; i < n; i++ {
+		entry := data[44+20*i:]
+		offset, compressed, length := binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:]), binary.BigEndian.Uint32(entry[12:])
+		if uint64(offset)+uint64(compressed) > uint64(len(data)) || compressed > length {
+			return nil, errFontFormat
+		}
+		if size += int(length); size > maxFontSize {
+			return nil, errFontFormat
+		}
+		table := data[offset : offset+compressed]
+		if compressed < length {
+			zr, err := zlib.NewReader(bytes.NewReader(table))
+			if err != nil {
+				return nil, err
+			}
+			table, err = ioutil.ReadAll(io.LimitReader(zr, int64(length)+1))
+			zr.Close()
+			if err != nil {
+				return nil, err
+			}
+			if len(table) != int(length) {
+				return nil, errFontFormat
+			}
+		}
+		f.tables = append(f.tables, sfntTable{string(entry[:4]), table})
+	}
+	return f, nil
+}
+
+func (f *sfntFont) table(tag string) []byte {
+	for _, t := range f.tables {
+		if t.tag == tag {
+			return t.data
+		}
+	}
+	return nil
+}
+
+func (f *sfntFont) setTable(tag string, data []byte) {
+	for i := range f.tables {
+		if f.tables[i].tag == tag {
+			f.tables[i].data = data
+			return
+		}
+	}
+}
+
+func (f *sfntFont) removeTable(tag string) {
+	for i := range f.tables {
+		if f.tables[i].tag == tag {
+			f.tables = append(f.tables[:i], f.tables[i+1:]...)
+			return
+		}
+	}
+}
+
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+func sfntChecksum(data []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(data); i += 4 {
+		var word [4]byte
+		copy(word[:], data[i:])
+		sum += binary.BigEndian.Uint32(word[:])
+	}
+	return sum
+}
+
+// sfnt encodes the font as TrueType or OpenType.
+func (f *sfntFont) sfnt() []byte {
+	n := len(f.tables)
+	entrySelector := 0
+	for 2<<entrySelector <= n {
+		entrySelector++
+	}
+	searchRange := 16 << entrySelector
+	size := 12 + 16*n
+	for _, t := range f.tables {
+		size += pad4(len(t.data))
+	}
+	out := make([]byte, 12+16*n, size)
+	binary.BigEndian.PutUint32(out, f.flavor)
+	binary.BigEndian.PutUint16(out[4:], uint16(n))
+	binary.BigEndian.PutUint16(out[6:], uint16(searchRange))
+	binary.BigEndian.PutUint16(out[8:], uint16(entrySelector))
+	binary.BigEndian.PutUint16(out[10:], uint16(16*n-searchRange))
+	head := -1
+	for i, t := range f.tables {
+		record := out[12+16*i:]
+		copy(record, t.tag)
+		if t.tag == "head" && len(t.data) >= 12 {
+			head = len(out)
+		}
+		binary.BigEndian.PutUint32(record[8:], uint32(len(out)))
+		binary.BigEndian.PutUint32(record[12:], uint32(len(t.data)))
+		out = append(out, t.data...)
+		out = append(out, make([]byte, pad4(len(t.data))-len(t.data))...)
+	}
+	if head >= 0 {
+		// the checksum adjustment is computed with itself zeroed
+		binary.BigEndian.PutUint32(out[head+8:], 0)
+	}
+	for i, t := range f.tables {
+		record := out[12+16*i:]
+		offset := binary.BigEndian.Uint32(record[8:])
+		binary.BigEndian.PutUint32(record[4:], sfntChecksum(out[offset:offset+uint32(len(t.data))]))
+	}
+	if head >= 0 {
+		binary.BigEndian.PutUint32(out[head+8:], 0xb1b0afba-sfntChecksum(out))
+	}
+	return out
+}
+
+// woff2Tags are the table tags WOFF2 encodes in a byte.
+var woff2Tags = map[string]byte{}
+
+func init() {
+	for i, tag := range []string{
+		"cmap", "head", "hhea", "hmtx", "maxp", "name", "OS/2", "post",
+		"cvt ", "fpgm", "glyf", "loca", "prep", "CFF ", "VORG", "EBDT",
+		"EBLC", "gasp", "hdmx", "kern", "LTSH", "PCLT", "VDMX", "vhea",
+		"vmtx", "BASE", "GDEF", "GPOS", "GSUB", "EBSC", "JSTF", "MATH",
+		"CBDT", "CBLC", "COLR", "CPAL", "SVG ", "sbix", "acnt", "avar",
+		"bdat", "bloc", "bsln", "cvar", "fdsc", "feat", "fmtx", "fvar",
+		"gvar", "hsty", "just", "lcar", "mort", "morx", "opbd", "prop",
+		"trak", "Zapf", "Silf", "Glat", "Gloc", "Feat", "Sill",
+	} {
+		woff2Tags[tag] = byte(i)
+	}
+}
+
+func appendBase128(b []byte, v uint32) []byte {
+	n := 1
+	for v>>(7*n) != 0 && n < 5 {
+		n++
+	}
+	for i := n - 1; i >= 0; i-- {
+		c := byte(v>>(7*i)) & 0x7f
+		if i > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+	}
+	return b
+}
+
+// woff2 encodes the font as WOFF2. All tables use the null transform,
+// leaving the compression to brotli.
+func (f *sfntFont) woff2() ([]byte, error) {
+	var directory []byte
+	var stream bytes.Buffer
+	sfntSize := 12 + 16*len(f.tables)
+	for _, t := range f.tables {
+		flags, known := woff2Tags[t.tag]
+		if !known {
+			flags = 63
+		}
+		if t.tag == "glyf" || t.tag == "loca" {
+			// for these, transform 0 is the glyph transform
+			flags |= 3 << 6
+		}
+		directory = append(directory, flags)
+		if !known {
+			directory = append(directory, t.tag...)
+		}
+		directory = appendBase128(directory, uint32(len(t.data)))
+		stream.Write(t.data)
+		sfntSize += pad4(len(t.data))
+	}
+	var compressed bytes.Buffer
+	bw := newBrotliWriter(&compressed, woff2Quality, 0)
+	if _, err := bw.Write(stream.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := bw.Close(); err != nil {
+		return nil, err
+	}
+
+	length := pad4(48 + len(directory) + compressed.Len())
+	out := make([]byte, 48, length)
+	copy(out, "wOF2")
+	binary.BigEndian.PutUint32(out[4:], f.flavor)
+	binary.BigEndian.PutUint32(out[8:], uint32(length))
+	binary.BigEndian.PutUint16(out[12:], uint16(len(f.tables)))
+	binary.BigEndian.PutUint32(out[16:], uint32(sfntSize))
+	binary.BigEndian.PutUint32(out[20:], uint32(compressed.Len()))
+	binary.BigEndian.PutUint16(out[24:], 1)
+	out = append(out, directory...)
+	out = append(out, compressed.Bytes()...)
+	return append(out, make([]byte, length-len(out))...), nil
+}
@@ -0,0 +1,309 @@
+package transcoder
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// latinRanges are the characters kept by Latin subsetting, the Latin and
+// Latin Extended ranges of Google Fonts and the Latin ligatures, which
+// ligature substitutions may map to.
+var latinRanges = [][2]rune{
+	{0x0000, 0x02af}, {0x02bb, 0x02bc}, {0x02c6, 0x02c6}, {0x02da, 0x02da},
+	{0x02dc, 0x02dc}, {0x0304, 0x0304}, {0x0308, 0x0308}, {0x0329, 0x0329},
+	{0x1e00, 0x1e9f}, {0x1ef2, 0x1eff}, {0x2000, 0x206f}, {0x2074, 0x2074},
+	{0x20a0, 0x20c0}, {0x2113, 0x2113}, {0x2122, 0x2122}, {0x2191, 0x2191},
+	{0x2193, 0x2193}, {0x2212, 0x2212}, {0x2215, 0x2215}, {0x2c60, 0x2c7f},
+	{0xa720, 0xa7ff}, {0xfb00, 0xfb06}, {0xfeff, 0xfeff}, {0xfffd, 0xfffd},
+}
+
+func isLatin(r rune) bool {
+	i := sort.Search(len(latinRanges), func(i int) bool { return latinRanges[i][1] >= r })
+	return i < len(latinRanges) && latinRanges[i][0] <= r
+}
+
+// Composite glyph flags.
+const (
+	argsAreWords    = 0x0001
+	haveScale       = 0x0008
+	moreComponents  = 0x0020
+	haveXYScale     = 0x0040
+	haveTwoByTwo    = 0x0080
+	maxGlyphsParsed = 1 << 16
+)
+
+// subsetLatin empties the glyphs only mapped from characters outside of
+// latinRanges and removes these characters from the cmap table. Glyph IDs
+// are kept, so the tables referring to them stay valid. It returns false,
+// leaving the font unchanged, if there is nothing to remove or the font
+// can't be subset.
+func (f *sfntFont) subsetLatin() bool {
+	glyf, loca, head, maxp := f.table("glyf"), f.table("loca"), f.table("head"), f.table("maxp")
+	if glyf == nil || loca == nil || len(head) < 54 || len(maxp) < 6 || f.table("fvar") != nil {
+		return false
+	}
+	numGlyphs := int(binary.BigEndian.Uint16(maxp[4:]))
+	long := binary.BigEndian.Uint16(head[50:]) != 0
+	offsets := parseLoca(loca, numGlyphs, long, len(glyf))
+	mapping := parseCmap(f.table("cmap"))
+	if offsets == nil || mapping == nil {
+		return false
+	}
+
+	latin := make(map[rune]uint16)
+	latinGlyphs := make([]bool, numGlyphs)
+	for r, g := range mapping {
+		if isLatin(r) && int(g) < numGlyphs {
+			latin[r] = g
+			latinGlyphs[g] = true
+		}
+	}
+	if len(latin) == len(mapping) || len(latin) == 0 {
+		return false
+	}
+	keep := make([]bool, numGlyphs)
+	for g := range keep {
+		keep[g] = true
+	}
+	for r, g := range mapping {
+		if !isLatin(r) && g != 0 && int(g) < numGlyphs && !latinGlyphs[g] {
+			keep[g] = false
+		}
+	}
+	// composite glyphs need their components
+	var queue []int
+	for g := range keep {
+		if keep[g] {
+			queue = append(queue, g)
+		}
+	}
+	for len(queue) > 0 {
+		g := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		for _, c := range glyphComponents(glyf[offsets[g]:offsets[g+1]]) {
+			if int(c) < numGlyphs && !keep[c] {
+				keep[c] = true
+				queue = append(queue, int(c))
+			}
+		}
+	}
+
+	var newGlyf, newLoca []byte
+	appendOffset := func() {
+		if long {
+			newLoca = binary.BigEndian.AppendUint32(newLoca, uint32(len(newGlyf)))
+		} else {
+			newLoca = binary.BigEndian.AppendUint16(newLoca, uint16(len(newGlyf)/2))
+		}
+	}
+	for g := 0; g < numGlyphs; g++ {
+		appendOffset()
+		if keep[g] {
+			newGlyf = append(newGlyf, glyf[offsets[g]:offsets[g+1]]...)
+			if len(newGlyf)%2 != 0 {
+				newGlyf = append(newGlyf, 0)
+			}
+		}
+	}
+	appendOffset()
+	f.setTable("glyf", newGlyf)
+	f.setTable("loca", newLoca)
+	f.setTable("cmap", buildCmap(latin))
+	// a signature no longer matches
+	f.removeTable("DSIG")
+	return true
+}
+
+// parseLoca returns the glyph offsets in the glyf table, nil if they are
+// invalid.
+func parseLoca(loca []byte, numGlyphs int, long bool, glyfSize int) []int {
+	size := 2
+	if long {
+		size = 4
+	}
+	if len(loca) < (numGlyphs+1)*size {
+		return nil
+	}
+	offsets := make([]int, numGlyphs+1)
+	for i := range offsets {
+		if long {
+			offsets[i] = int(binary.BigEndian.Uint32(loca[4*i:]))
+		} else {
+			offsets[i] = 2 * int(binary.BigEndian.Uint16(loca[2*i:]))
+		}
+		if offsets[i] > glyfSize || i > 0 && offsets[i] < offsets[i-1] {
+			return nil
+		}
+	}
+	return offsets
+}
+
+// glyphComponents returns the glyphs a composite glyph is made of.
+func glyphComponents(glyph []byte) []uint16 {
+	if len(glyph) < 10 || int16(binary.BigEndian.Uint16(glyph)) >= 0 {
+		return nil
+	}
+	var components []uint16
+	for p := 10; p+4 <= len(glyph); {
+		flags := binary.BigEndian.Uint16(glyph[p:])
+		components = append(components, binary.BigEndian.Uint16(glyph[p+2:]))
+		p += 4
+		if flags&argsAreWords != 0 {
+			p += 4
+		} else {
+			p += 2
+		}
+		switch {
+		case flags&haveScale != 0:
+			p += 2
+		case flags&haveXYScale != 0:
+			p += 4
+		case flags&haveTwoByTwo != 0:
+			p += 8
+		}
+		if flags&moreComponents == 0 {
+			break
+		}
+	}
+	return components
+}
+
+// parseCmap returns the character to glyph mapping of the Unicode subtable
+// of a cmap table, nil if there is none it can read.
+func parseCmap(cmap []byte) map[rune]uint16 {
+	if len(cmap) < 4 {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint16(cmap[2:]))
+	best, bestRank := -1, 0
+	for i := 0; i < n && 4+8*i+8 <= len(cmap); i++ {
+		record := cmap[4+8*i:]
+		platform, encoding := binary.BigEndian.Uint16(record), binary.BigEndian.Uint16(record[2:])
+		offset := int(binary.BigEndian.Uint32(record[4:]))
+		if offset+2 > len(cmap) {
+			continue
+		}
+		format := binary.BigEndian.Uint16(cmap[offset:])
+		rank := 0
+		switch {
+		case format == 12 && (platform == 0 || platform == 3 && encoding == 10):
+			rank = 2
+		case format == 4 && (platform == 0 || platform == 3 && encoding == 1):
+			rank = 1
+		}
+		if rank > bestRank {
+			best, bestRank = offset, rank
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	if bestRank == 2 {
+		return parseCmap12(cmap[best:])
+	}
+	return parseCmap4(cmap[best:])
+}
+
+func parseCmap4(table []byte) map[rune]uint16 {
+	if len(table) < 14 {
+		return nil
+	}
+	segCount := int(binary.BigEndian.Uint16(table[6:]) / 2)
+	if len(table) < 16+8*segCount {
+		return nil
+	}
+	ends, starts := table[14:], table[16+2*segCount:]
+	deltas, rangeOffsets := table[16+4*segCount:], table[16+6*segCount:]
+	mapping := make(map[rune]uint16)
+	for i := 0; i < segCount; i++ {
+		start, end := int(binary.BigEndian.Uint16(starts[2*i:])), int(binary.BigEndian.Uint16(ends[2*i:]))
+		delta, rangeOffset := binary.BigEndian.Uint16(deltas[2*i:]), int(binary.BigEndian.Uint16(rangeOffsets[2*i:]))
+		for c := start; c <= end && c != 0xffff; c++ {
+			g := uint16(c) + delta
+			if rangeOffset != 0 {
+				p := 16 + 6*segCount + 2*i + rangeOffset + 2*(c-start)
+				if p+2 > len(table) {
+					return nil
+				}
+				if g = binary.BigEndian.Uint16(table[p:]); g != 0 {
+					g += delta
+				}
+			}
+			if g != 0 {
+				mapping[rune(c)] = g
+			}
+		}
+	}
+	return mapping
+}
+
+func parseCmap12(table []byte) map[rune]uint16 {
+	if len(table) < 16 {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint32(table[12:]))
+	if n > (len(table)-16)/12 {
+		return nil
+	}
+	mapping := make(map[rune]uint16)
+	for i := 0; i < n; i++ {
+		group := table[16+12*i:]
+		start, end, g := binary.BigEndian.Uint32(group), binary.BigEndian.Uint32(group[4:]), binary.BigEndian.Uint32(group[8:])
+		if end < start || end > 0x10ffff || len(mapping)+int(end-start) > maxGlyphsParsed {
+			return nil
+		}
+		for c := start; c <= end; c++ {
+			if id := g + c - start; id != 0 && id <= 0xffff {
+				mapping[rune(c)] = uint16(id)
+			}
+		}
+	}
+	return mapping
+}
+
+// buildCmap returns a cmap table with a format 4 subtable mapping the
+// characters, which must all be in the Basic Multilingual Plane.
+func buildCmap(mapping map[rune]uint16) []byte {
+	chars := make([]rune, 0, len(mapping))
+	for r := range mapping {
+		if r < 0xffff {
+			chars = append(chars, r)
+		}
+	}
+	sort.Slice(chars, func(i, j int) bool { return chars[i] < chars[j] })
+	type segment struct{ start, end, delta uint16 }
+	var segments []segment
+	for _, r := range chars {
+		c, g := uint16(r), mapping[r]
+		if last := len(segments) - 1; last >= 0 && segments[last].end+1 == c && segments[last].end+segments[last].delta+1 == g {
+			segments[last].end = c
+			continue
+		}
+		segments = append(segments, segment{c, c, g - c})
+	}
+	segments = append(segments, segment{0xffff, 0xffff, 1})
+
+	segCount := len(segments)
+	entrySelector := 0
+	for 2<<entrySelector <= segCount {
+		entrySelector++
+	}
+	searchRange := 2 << entrySelector
+	// the header, with the same subtable for the Unicode and Windows
+	// platforms
+	out := []byte{0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 20, 0, 3, 0, 1, 0, 0, 0, 20}
+	for _, v := range []int{4, 16 + 8*segCount, 0, 2 * segCount, searchRange, entrySelector, 2*segCount - searchRange} {
+		out = binary.BigEndian.AppendUint16(out, uint16(v))
+	}
+	for _, s := range segments {
+		out = binary.BigEndian.AppendUint16(out, s.end)
+	}
+	out = append(out, 0, 0)
+	for _, s := range segments {
+		out = binary.BigEndian.AppendUint16(out, s.start)
+	}
+	for _, s := range segments {
+		out = binary.BigEndian.AppendUint16(out, s.delta)
+	}
+	return append(out, make([]byte, 2*segCount)...)
+}
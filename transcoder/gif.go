@@ -2,27 +2,33 @@ package transcoder
 
 import (
 	"github.com/barnacs/compy/proxy"
-	"github.com/chai2010/webp"
 	"image/gif"
 	"net/http"
 )
 
-type Gif struct{}
+type Gif struct {
+	// Avif enables AVIF output for clients accepting it, nil to disable.
+	Avif *Avif
+}
 
 func (t *Gif) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
 	img, err := gif.Decode(r)
 	if err != nil {
 		return err
 	}
-	if SupportsWebP(headers) {
+	addVary(w.Header(), "Accept")
+	format, release := t.Avif.negotiate(headers, "image/gif", true)
+	defer release()
+	switch format {
+	case "image/avif":
+		w.Header().Set("Content-Type", "image/avif")
+		return encodeAvif(w, img, t.Avif.Quality, t.Avif.Speed)
+	case "image/webp":
 		w.Header().Set("Content-Type", "image/webp")
-		options := webp.Options{
-			Lossless: true,
-		}
-		if err = webp.Encode(w, img, &options); err != nil {
+		if err = encodeWebP(w, img, true, 0); err != nil {
 			return err
 		}
-	} else {
+	default:
 		if err = gif.Encode(w, img, nil); err != nil {
 			return err
 		}
@@ -0,0 +1,211 @@
+package transcoder
+
+import (
+	"encoding/binary"
+	"image"
+	"math"
+)
+
+// iccProfile is an RGB matrix/TRC color profile, the kind cameras and
+// editors embed for wide gamut spaces like Adobe RGB or Display P3.
+// Profiles based on lookup tables aren't supported and left alone.
+type iccProfile struct {
+	// linear maps 8-bit channel values to linear light.
+	linear [3][256]float64
+	// matrix maps linear RGB to linear sRGB.
+	matrix [3][3]float64
+}
+
+// srgbD50 is the sRGB to XYZ matrix adapted to the D50 white point of the
+// ICC profile connection space, with the primaries as columns.
+var srgbD50 = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+// xyzD50ToSRGB is the inverse of srgbD50.
+var xyzD50ToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// parseICC returns the conversion to sRGB for a matrix/TRC RGB profile,
+// or nil if there's nothing to convert: no profile, an unsupported one, or
+// one matching sRGB.
+func parseICC(b []byte) *iccProfile {
+	if len(b) < 132 || string(b[16:20]) != "RGB " || string(b[20:24]) != "XYZ " {
+		return nil
+	}
+	tags := make(map[string][]byte)
+	n := int(binary.BigEndian.Uint32(b[128:]))
+	for i := 0; i < n && 132+12*i+12 <= len(b); i++ {
+		entry := b[132+12*i:]
+		offset, size := int(binary.BigEndian.Uint32(entry[4:])), int(binary.BigEndian.Uint32(entry[8:]))
+		if offset < 0 || size < 0 || offset+size > len(b) {
+			return nil
+		}
+		tags[string(entry[:4])] = b[offset : offset+size]
+	}
+
+	var primaries [3][3]float64
+	p := &iccProfile{}
+	for ch, name := range []string{"r", "g", "b"} {
+		xyz := tags[name+"XYZ"]
+		if len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil
+		}
+		for i := 0; i < 3; i++ {
+			primaries[i][ch] = s15Fixed16(xyz[8+4*i:])
+		}
+		if !parseTRC(tags[name+"TRC"], &p.linear[ch]) {
+			return nil
+		}
+	}
+	if isSRGB(primaries, &p.linear) {
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				p.matrix[i][j] += xyzD50ToSRGB[i][k] * primaries[k][j]
+			}
+		}
+	}
+	return p
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseTRC fills lut from a curv or para tone reproduction curve.
+func parseTRC(b []byte, lut *[256]float64) bool {
+	if len(b) < 12 {
+		return false
+	}
+	switch string(b[:4]) {
+	case "curv":
+		count := int(binary.BigEndian.Uint32(b[8:]))
+		switch {
+		case count == 0:
+			for i := range lut {
+				lut[i] = float64(i) / 255
+			}
+		case count == 1:
+			gamma := float64(binary.BigEndian.Uint16(b[12:])) / 256
+			for i := range lut {
+				lut[i] = math.Pow(float64(i)/255, gamma)
+			}
+		case len(b) >= 12+2*count:
+			for i := range lut {
+				pos := float64(i) / 255 * float64(count-1)
+				lo := int(pos)
+				hi := lo + 1
+				if hi >= count {
+					hi = lo
+				}
+				a := float64(binary.BigEndian.Uint16(b[12+2*lo:])) / 65535
+				c := float64(binary.BigEndian.Uint16(b[12+2*hi:])) / 65535
+				lut[i] = a + (c-a)*(pos-float64(lo))
+			}
+		default:
+			return false
+		}
+	case "para":
+		// parameter counts of the function types
+		counts := []int{1, 3, 4, 5, 7}
+		typ := int(binary.BigEndian.Uint16(b[8:]))
+		if typ >= len(counts) || len(b) < 12+4*counts[typ] {
+			return false
+		}
+		var params [7]float64
+		for i := 0; i < counts[typ]; i++ {
+			params[i] = s15Fixed16(b[12+4*i:])
+		}
+		g, a, pb, c, d, e, f := params[0], params[1], params[2], params[3], params[4], params[5], params[6]
+		for i := range lut {
+			x := float64(i) / 255
+			var y float64
+			switch typ {
+			case 0:
+				y = math.Pow(x, g)
+			case 1:
+				if x >= -pb/a {
+					y = math.Pow(a*x+pb, g)
+				}
+			case 2:
+				y = c
+				if x >= -pb/a {
+					y += math.Pow(a*x+pb, g)
+				}
+			case 3:
+				y = c * x
+				if x >= d {
+					y = math.Pow(a*x+pb, g)
+				}
+			case 4:
+				y = c*x + f
+				if x >= d {
+					y = math.Pow(a*x+pb, g) + e
+				}
+			}
+			lut[i] = y
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// isSRGB tells whether a profile is close enough to sRGB to leave the
+// colors alone.
+func isSRGB(primaries [3][3]float64, linear *[3][256]float64) bool {
+	for i := range primaries {
+		for j := range primaries[i] {
+			if math.Abs(primaries[i][j]-srgbD50[i][j]) > 0.01 {
+				return false
+			}
+		}
+	}
+	for ch := range linear {
+		for i, v := range linear[ch] {
+			if math.Abs(v-srgbLinear(float64(i)/255)) > 0.01 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func srgbLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// toSRGB converts the colors of img in place.
+func (p *iccProfile) toSRGB(img *image.NRGBA) {
+	// encode through a table, fine enough for 8-bit output
+	const steps = 4096
+	var encode [steps + 1]uint8
+	for i := range encode {
+		encode[i] = uint8(math.Round(255 * srgbEncode(float64(i)/steps)))
+	}
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r, g, b := p.linear[0][img.Pix[i]], p.linear[1][img.Pix[i+1]], p.linear[2][img.Pix[i+2]]
+		for ch := 0; ch < 3; ch++ {
+			v := p.matrix[ch][0]*r + p.matrix[ch][1]*g + p.matrix[ch][2]*b
+			img.Pix[i+ch] = encode[int(math.Round(math.Max(0, math.Min(1, v))*steps))]
+		}
+	}
+}
@@ -8,5 +8,6 @@ import (
 type Identity struct{}
 
 func (i *Identity) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
-	return w.ReadFrom(r)
+	_, err := w.ReadFrom(r)
+	return err
 }
@@ -0,0 +1,62 @@
+package transcoder
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	integrityTTL      = 24 * time.Hour
+	maxIntegrityURLs  = 1 << 16
+	integritySweepMin = time.Minute
+)
+
+// IntegrityURLs remembers the scripts and stylesheets pages reference with
+// an integrity attribute (Subresource Integrity), which browsers reject if
+// their bodies change. Entries expire, as pages may drop the attribute and
+// the resources may still be cached when the pages aren't.
+type IntegrityURLs struct {
+	mu        sync.Mutex
+	urls      map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewIntegrityURLs() *IntegrityURLs {
+	return &IntegrityURLs{urls: make(map[string]time.Time)}
+}
+
+// Add remembers a URL referenced with an integrity attribute.
+func (s *IntegrityURLs) Add(url string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if len(s.urls) >= maxIntegrityURLs && now.Sub(s.lastSweep) > integritySweepMin {
+		s.lastSweep = now
+		for u, expires := range s.urls {
+			if now.After(expires) {
+				delete(s.urls, u)
+			}
+		}
+	}
+	for u := range s.urls {
+		if len(s.urls) < maxIntegrityURLs {
+			break
+		}
+		delete(s.urls, u)
+	}
+	s.urls[url] = now.Add(integrityTTL)
+}
+
+// Contains tells whether a URL was referenced with an integrity attribute.
+func (s *IntegrityURLs) Contains(url string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.urls[url]
+	return ok && time.Now().Before(expires)
+}
@@ -1,57 +1,113 @@
 package transcoder
 
 import (
+	"bytes"
 	"github.com/barnacs/compy/proxy"
-	"github.com/chai2010/webp"
-	"github.com/pixiv/go-libjpeg/jpeg"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 )
 
 type Jpeg struct {
-	decOptions *jpeg.DecoderOptions
-	encOptions *jpeg.EncoderOptions
+	quality int
+	// Avif enables AVIF output for clients accepting it, nil to disable.
+	Avif *Avif
+	// KeepMetadata keeps EXIF and XMP data in JPEG output. Images are
+	// always rotated upright and converted to sRGB, and other formats never
+	// carry metadata.
+	KeepMetadata bool
+	// Progressive enables progressive JPEG output, which shows a coarse
+	// preview of the image while it loads.
+	Progressive bool
+	// Subsampling is the chroma subsampling of JPEG output, "444", "422" or
+	// "420", empty for the encoder's default.
+	Subsampling string
+	// TargetSSIM enables adaptive quality when positive: JPEG output gets
+	// the lowest quality, up to the configured one, that keeps at least this
+	// structural similarity (0-1) to the original.
+	TargetSSIM float64
 }
 
 func NewJpeg(quality int) *Jpeg {
 	return &Jpeg{
-		decOptions: &jpeg.DecoderOptions{},
-		encOptions: &jpeg.EncoderOptions{
-			Quality:        quality,
-			OptimizeCoding: true,
-		},
+		quality: quality,
 	}
 }
 
 func (t *Jpeg) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
-	img, err := jpeg.Decode(r, t.decOptions)
+	// the metadata precedes the image data, but the decoder doesn't expose it
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
+	meta := readJpegMetadata(data)
+	img, err := decodeJpeg(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	img = meta.normalize(img)
 
-	encOptions := t.encOptions
-	qualityString := headers.Get("X-Compy-Quality")
+	quality := t.quality
+	avifQuality := 0
+	if t.Avif.enabled() {
+		avifQuality = t.Avif.Quality
+	}
+	qualityString := headers.Get(proxy.QualityHeader)
 	if qualityString != "" {
-		if quality, err := strconv.Atoi(qualityString); err != nil {
+		if quality, err = strconv.Atoi(qualityString); err != nil {
 			return err
-		} else {
-			encOptions.Quality = quality
 		}
+		avifQuality = quality
 	}
 
-	if SupportsWebP(headers) {
+	addVary(w.Header(), "Accept")
+	format, release := t.Avif.negotiate(headers, "image/jpeg", LossyWebP)
+	defer release()
+
+	switch format {
+	case "image/avif":
+		w.Header().Set("Content-Type", "image/avif")
+		return encodeAvif(w, img, avifQuality, t.Avif.Speed)
+	case "image/webp":
 		w.Header().Set("Content-Type", "image/webp")
-		options := webp.Options{
-			Lossless: false,
-			Quality:  float32(encOptions.Quality),
-		}
-		if err = webp.Encode(w, img, &options); err != nil {
-			return err
-		}
+		return encodeWebP(w, img, false, quality)
+	}
+
+	options := jpegOptions{
+		quality:     quality,
+		progressive: t.Progressive,
+		subsampling: t.Subsampling,
+	}
+	var out []byte
+	if t.TargetSSIM > 0 && qualityString == "" {
+		out, err = encodeJpegSSIM(img, options, t.TargetSSIM)
 	} else {
-		if err = jpeg.Encode(w, img, encOptions); err != nil {
-			return err
+		var buf bytes.Buffer
+		err = encodeJpeg(&buf, img, options)
+		out = buf.Bytes()
+	}
+	if err != nil {
+		return err
+	}
+
+	// metadata goes right after the SOI marker
+	if _, err = w.Write(out[:2]); err != nil {
+		return err
+	}
+	if t.KeepMetadata {
+		for _, segment := range meta.segments {
+			if _, err = w.Write(segment); err != nil {
+				return err
+			}
 		}
 	}
-	return nil
+	_, err = w.Write(out[2:])
+	return err
+}
+
+// jpegOptions are the settings JPEG images are encoded with.
+type jpegOptions struct {
+	quality     int
+	progressive bool
+	subsampling string
 }
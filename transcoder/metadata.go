@@ -0,0 +1,204 @@
+package transcoder
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io/ioutil"
+)
+
+// metadata is what compy keeps from an image's metadata. Everything else,
+// such as camera data, thumbnails and comments, is dropped by re-encoding.
+type metadata struct {
+	// orientation is the EXIF orientation, 1-8, 0 if absent.
+	orientation int
+	// icc is the embedded color profile.
+	icc []byte
+	// segments are the JPEG APP1 segments holding EXIF and XMP data, with
+	// the orientation reset, for keeping metadata.
+	segments [][]byte
+}
+
+const (
+	jpegSOI  = 0xD8
+	jpegSOS  = 0xDA
+	jpegAPP1 = 0xE1
+	jpegAPP2 = 0xE2
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	iccHeader  = []byte("ICC_PROFILE\x00")
+)
+
+// readJpegMetadata scans the JPEG markers preceding the image data.
+func readJpegMetadata(b []byte) *metadata {
+	m := &metadata{}
+	if len(b) < 2 || b[0] != 0xFF || b[1] != jpegSOI {
+		return m
+	}
+	var iccChunks [][]byte
+	for i := 2; i+4 <= len(b) && b[i] == 0xFF; {
+		marker := b[i+1]
+		if marker == 0xFF {
+			// fill byte
+			i++
+			continue
+		}
+		if marker == jpegSOS {
+			break
+		}
+		// the length counts itself
+		n := int(binary.BigEndian.Uint16(b[i+2:]))
+		if n < 2 || i+2+n > len(b) {
+			break
+		}
+		end := i + 2 + n
+		payload := b[i+4 : end]
+		switch {
+		case marker == jpegAPP1 && bytes.HasPrefix(payload, exifHeader):
+			segment := append([]byte{}, b[i:end]...)
+			tiff := segment[4+len(exifHeader):]
+			if pos := exifOrientation(tiff, &m.orientation); pos >= 0 {
+				// the orientation is applied to the pixels
+				tiffOrder(tiff).PutUint16(tiff[pos:], 1)
+			}
+			m.segments = append(m.segments, segment)
+		case marker == jpegAPP1 && bytes.HasPrefix(payload, xmpHeader):
+			m.segments = append(m.segments, b[i:end])
+		case marker == jpegAPP2 && bytes.HasPrefix(payload, iccHeader) && len(payload) > len(iccHeader)+2:
+			// profiles are split into numbered chunks
+			seq := int(payload[len(iccHeader)])
+			for len(iccChunks) < seq {
+				iccChunks = append(iccChunks, nil)
+			}
+			if seq > 0 {
+				iccChunks[seq-1] = payload[len(iccHeader)+2:]
+			}
+		}
+		i = end
+	}
+	m.icc = bytes.Join(iccChunks, nil)
+	return m
+}
+
+// exifOrientation reads the orientation tag from the first IFD of a TIFF
+// structure and returns the offset of its value, or -1 if missing.
+func exifOrientation(tiff []byte, orientation *int) int {
+	order := tiffOrder(tiff)
+	if len(tiff) < 8 || order == nil {
+		return -1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) || ifd < 8 {
+		return -1
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				*orientation = o
+			}
+			return entry + 8
+		}
+	}
+	return -1
+}
+
+func tiffOrder(tiff []byte) binary.ByteOrder {
+	switch {
+	case bytes.HasPrefix(tiff, []byte("II")):
+		return binary.LittleEndian
+	case bytes.HasPrefix(tiff, []byte("MM")):
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// readPngMetadata reads the iCCP and eXIf chunks preceding the image data.
+func readPngMetadata(b []byte) *metadata {
+	m := &metadata{}
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(b, []byte(signature)) {
+		return m
+	}
+	for i := len(signature); i+8 <= len(b); {
+		length := int(binary.BigEndian.Uint32(b[i:]))
+		typ := string(b[i+4 : i+8])
+		if length < 0 || i+12+length > len(b) || typ == "IDAT" {
+			break
+		}
+		data := b[i+8 : i+8+length]
+		switch typ {
+		case "iCCP":
+			// profile name, compression method, zlib stream
+			if name := bytes.IndexByte(data, 0); name >= 0 && name+2 <= len(data) {
+				if zr, err := zlib.NewReader(bytes.NewReader(data[name+2:])); err == nil {
+					m.icc, _ = ioutil.ReadAll(zr)
+				}
+			}
+		case "eXIf":
+			exifOrientation(data, &m.orientation)
+		}
+		i += 12 + length
+	}
+	return m
+}
+
+// normalize applies the orientation and converts the colors to sRGB, so
+// that the image looks the same without its metadata.
+func (m *metadata) normalize(img image.Image) image.Image {
+	icc := parseICC(m.icc)
+	if icc == nil && m.orientation <= 1 {
+		return img
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	if icc != nil {
+		icc.toSRGB(nrgba)
+	}
+	return orient(nrgba, m.orientation)
+}
+
+// orient transforms an image with the given EXIF orientation to be shown
+// upright.
+func orient(img *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		dst = image.NewNRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], img.Pix[img.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
@@ -1,30 +1,248 @@
 package transcoder
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
 	"github.com/barnacs/compy/proxy"
 	"github.com/tdewolff/minify/v2"
 	"github.com/tdewolff/minify/v2/css"
 	"github.com/tdewolff/minify/v2/html"
 	"github.com/tdewolff/minify/v2/js"
-	"net/http"
+	"github.com/tdewolff/minify/v2/json"
+	"github.com/tdewolff/minify/v2/svg"
+	"github.com/tdewolff/minify/v2/xml"
+	"github.com/tdewolff/parse/v2"
+	jsparse "github.com/tdewolff/parse/v2/js"
+)
+
+// MinifyMode says how responses are minified.
+type MinifyMode int
+
+const (
+	MinifyOff MinifyMode = iota
+	// MinifyConservative keeps what pages are known to depend on:
+	// conditional comments, attribute quotes, end tags, default attribute
+	// values, variable names, CSS2 compatible syntax, JSON numbers as
+	// written and whitespace in XML.
+	MinifyConservative
+	MinifyAggressive
+)
+
+var minifyModes = map[string]MinifyMode{
+	"off":          MinifyOff,
+	"on":           MinifyConservative,
+	"conservative": MinifyConservative,
+	"aggressive":   MinifyAggressive,
+}
+
+func (m MinifyMode) String() string {
+	switch m {
+	case MinifyConservative:
+		return "conservative"
+	case MinifyAggressive:
+		return "aggressive"
+	}
+	return "off"
+}
+
+// MinifyRule sets the minify mode for responses from a host, "*.example.com"
+// for the domain and its subdomains or "*" for all hosts, of the given
+// content types, nil for all types.
+type MinifyRule struct {
+	Host  string
+	Types []string
+	Mode  MinifyMode
+}
+
+func (r *MinifyRule) matches(host, contentType string) bool {
+	if !matchHost(r.Host, host) {
+		return false
+	}
+	if r.Types == nil {
+		return true
+	}
+	for _, t := range r.Types {
+		if t == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost tells whether host matches pattern: a host name,
+// "*.example.com" for the domain and its subdomains or "*" for all hosts.
+func matchHost(pattern, host string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return host == pattern[2:] || strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// ParseMinifyRules reads minify rules, one per line: a host, comma
+// separated content types or "*", and a mode ("off", "on" or "conservative",
+// "aggressive"). Blank lines and lines starting with # are ignored.
+func ParseMinifyRules(r io.Reader) ([]MinifyRule, error) {
+	var rules []MinifyRule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected host, types and mode", n)
+		}
+		mode, ok := minifyModes[strings.ToLower(fields[2])]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown mode %q", n, fields[2])
+		}
+		rule := MinifyRule{Host: strings.ToLower(fields[0]), Mode: mode}
+		if fields[1] != "*" {
+			for _, t := range strings.Split(fields[1], ",") {
+				if t = strings.TrimSpace(t); t != "" {
+					rule.Types = append(rule.Types, strings.ToLower(t))
+				}
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+var (
+	jsonTypes = regexp.MustCompile(`^(application/json|text/json|application/[^/]+\+json)$`)
+	xmlTypes  = regexp.MustCompile(`^(application/xml|text/xml|application/[^/]+\+xml)$`)
 )
 
+// Minifier minifies HTML, CSS, JavaScript, SVG, JSON and XML. The minified body is only
+// sent if minifying succeeds, and for JavaScript if the result parses,
+// the original body otherwise.
 type Minifier struct {
-	m *minify.M
+	conservative *minify.M
+	aggressive   *minify.M
+	// Rules choose the mode by host and content type, the first matching
+	// rule winning. Responses matching none are minified per Default.
+	Rules   []MinifyRule
+	Default MinifyMode
+	// Integrity lists the resources pages check the integrity of, which
+	// are sent unchanged.
+	Integrity *IntegrityURLs
 }
 
 func NewMinifier() *Minifier {
-	m := minify.New()
-	m.AddFunc("text/html", html.Minify)
-	m.AddFunc("text/css", css.Minify)
-	m.AddFunc("text/javascript", js.Minify)
-	m.AddFunc("application/javascript", js.Minify)
-	m.AddFunc("application/x-javascript", js.Minify)
+	conservative := minify.New()
+	conservative.Add("text/html", &html.Minifier{
+		KeepConditionalComments: true,
+		KeepDefaultAttrVals:     true,
+		KeepDocumentTags:        true,
+		KeepEndTags:             true,
+		KeepQuotes:              true,
+	})
+	conservative.Add("text/css", &css.Minifier{KeepCSS2: true})
+	conservative.Add("text/javascript", &js.Minifier{KeepVarNames: true})
+	conservative.Add("application/javascript", &js.Minifier{KeepVarNames: true})
+	conservative.Add("image/svg+xml", &svg.Minifier{})
+	conservative.AddRegexp(jsonTypes, &json.Minifier{KeepNumbers: true})
+	conservative.AddRegexp(xmlTypes, &xml.Minifier{KeepWhitespace: true})
+
+	aggressive := minify.New()
+	aggressive.AddFunc("text/html", html.Minify)
+	aggressive.AddFunc("text/css", css.Minify)
+	aggressive.AddFunc("text/javascript", js.Minify)
+	aggressive.AddFunc("application/javascript", js.Minify)
+	aggressive.AddFunc("image/svg+xml", svg.Minify)
+	aggressive.AddFuncRegexp(jsonTypes, json.Minify)
+	aggressive.AddFuncRegexp(xmlTypes, xml.Minify)
 	return &Minifier{
-		m: m,
+		conservative: conservative,
+		aggressive:   aggressive,
+		Default:      MinifyConservative,
+	}
+}
+
+func (t *Minifier) String() string {
+	return fmt.Sprintf("Minifier(%s, %d rules)", t.Default, len(t.Rules))
+}
+
+// Mode returns the minify mode for a response from host.
+func (t *Minifier) Mode(host, contentType string) MinifyMode {
+	host = strings.ToLower(host)
+	for _, rule := range t.Rules {
+		if rule.matches(host, contentType) {
+			return rule.Mode
+		}
 	}
+	return t.Default
 }
 
 func (t *Minifier) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
-	return t.m.Minify(r.ContentType(), w, r)
+	host, checked := "", false
+	if req := r.Request(); req != nil {
+		host = req.URL.Hostname()
+		checked = t.Integrity.Contains(req.URL.String())
+	}
+	if checked || t.Mode(host, r.ContentType()) == MinifyOff || r.Header().Get("Content-Encoding") != "" {
+		_, err := w.ReadFrom(r)
+		return err
+	}
+	original, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(t.minify(host, r.ContentType(), original))
+	return err
+}
+
+// minify returns the minified body of a response from host, or the
+// original one if it can't be minified safely.
+func (t *Minifier) minify(host, contentType string, original []byte) []byte {
+	if contentType == "application/xhtml+xml" {
+		// neither the HTML nor the XML minifier keeps XHTML intact
+		return original
+	}
+	var m *minify.M
+	switch t.Mode(host, contentType) {
+	case MinifyConservative:
+		m = t.conservative
+	case MinifyAggressive:
+		m = t.aggressive
+	default:
+		return original
+	}
+	var minified bytes.Buffer
+	if err := m.Minify(mediaTypeAlias(contentType), &minified, bytes.NewReader(original)); err != nil || !verifyMinified(contentType, minified.Bytes()) {
+		return original
+	}
+	return minified.Bytes()
+}
+
+// mediaTypeAlias maps the JavaScript media type variants to the ones the
+// minifiers are registered for.
+func mediaTypeAlias(contentType string) string {
+	switch contentType {
+	case "application/x-javascript", "application/ecmascript", "text/ecmascript":
+		return "text/javascript"
+	}
+	return contentType
+}
+
+// verifyMinified tells whether minified output is safe to send, which for
+// JavaScript means it still parses.
+func verifyMinified(contentType string, minified []byte) bool {
+	if contentType = mediaTypeAlias(contentType); contentType != "text/javascript" && contentType != "application/javascript" {
+		return true
+	}
+	_, err := jsparse.Parse(parse.NewInputBytes(minified), jsparse.Options{})
+	return err == nil
 }
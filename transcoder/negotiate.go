@@ -0,0 +1,122 @@
+package transcoder
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Accept is a parsed Accept or Accept-Encoding header (RFC 9110, section
+// 12.5). Values containing a slash are media ranges, anything else is a
+// content coding.
+type Accept []acceptSpec
+
+type acceptSpec struct {
+	value string
+	q     float64
+}
+
+// ParseAccept parses a comma separated list of values with optional
+// weights, tolerating any whitespace around separators. Entries with an
+// invalid weight are ignored.
+func ParseAccept(header string) Accept {
+	var a Accept
+	for _, v := range strings.Split(header, ",") {
+		params := strings.Split(v, ";")
+		value := strings.ToLower(strings.TrimSpace(params[0]))
+		if value == "" {
+			continue
+		}
+		spec := acceptSpec{value: value, q: 1}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "q") {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+			if err != nil || q < 0 || q > 1 {
+				spec.q = -1
+				break
+			}
+			spec.q = q
+		}
+		if spec.q >= 0 {
+			a = append(a, spec)
+		}
+	}
+	return a
+}
+
+// specificity returns how closely spec matches value, -1 meaning not at
+// all.
+func (spec *acceptSpec) specificity(value string) int {
+	switch {
+	case spec.value == value:
+		return 3
+	case spec.value == "*" || spec.value == "*/*":
+		return 1
+	case strings.HasSuffix(spec.value, "/*") && strings.HasPrefix(value, spec.value[:len(spec.value)-1]):
+		return 2
+	}
+	return -1
+}
+
+// Quality returns the weight the header gives value, taken from the most
+// specific matching entry, and whether value was listed explicitly rather
+// than matched by a wildcard. The identity coding is acceptable unless
+// excluded. Values matching nothing get a weight of 0.
+func (a Accept) Quality(value string) (q float64, explicit bool) {
+	value = strings.ToLower(value)
+	best := -1
+	for i := range a {
+		if s := a[i].specificity(value); s > best {
+			best = s
+			q = a[i].q
+		}
+	}
+	switch {
+	case best < 0 && value == "identity":
+		return 1, false
+	case best < 0:
+		return 0, false
+	}
+	return q, best == 3
+}
+
+// Negotiate returns the acceptable offer with the highest weight, ties
+// going to the earlier offer, or an empty string if none is acceptable.
+func (a Accept) Negotiate(offers ...string) string {
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q, _ := a.Quality(offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// NegotiateExplicit is like Negotiate, but only considers offers listed
+// explicitly, e.g. to tell whether a client supports a newer image format
+// it would accept but not necessarily decode via "image/*".
+func (a Accept) NegotiateExplicit(offers ...string) string {
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q, explicit := a.Quality(offer); explicit && q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// addVary adds field to the Vary header of a negotiated response.
+func addVary(h http.Header, field string) {
+	for _, v := range h["Vary"] {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
@@ -0,0 +1,175 @@
+package transcoder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/png"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/barnacs/compy/proxy"
+	"golang.org/x/image/webp"
+)
+
+// placeholderSize is the larger side of placeholder previews in pixels.
+const placeholderSize = 8
+
+func placeholderRequested(headers http.Header) bool {
+	return strings.EqualFold(headers.Get(proxy.PlaceholderHeader), "on")
+}
+
+// Placeholder replaces images by a blurred preview of a few hundred bytes
+// with the same dimensions when the request asks for placeholders, see
+// proxy.PlaceholderHeader. Other requests are handled by the wrapped
+// transcoder.
+type Placeholder struct {
+	proxy.Transcoder
+}
+
+func (t *Placeholder) String() string {
+	return fmt.Sprintf("Placeholder(%T)", t.Transcoder)
+}
+
+func (t *Placeholder) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
+	if !placeholderRequested(headers) {
+		return t.Transcoder.Transcode(w, r, headers)
+	}
+	var decode func(io.Reader) (image.Image, error)
+	switch r.ContentType() {
+	case "image/jpeg":
+		decode = decodeJpeg
+	case "image/png":
+		decode = png.Decode
+	case "image/gif":
+		decode = gif.Decode
+	case "image/webp":
+		decode = webp.Decode
+	default:
+		return t.Transcoder.Transcode(w, r, headers)
+	}
+	img, err := decode(r)
+	if err != nil {
+		return err
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "image/svg+xml")
+	// the real image must be fetched when asked for without placeholders
+	h.Set("Cache-Control", "no-store")
+	h.Del("Expires")
+	h.Del("ETag")
+	h.Del("Last-Modified")
+	return writePlaceholder(w, img)
+}
+
+func writePlaceholder(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	preview, opaque := shrink(toRGBA(img), placeholderSize)
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, preview); err != nil {
+		return err
+	}
+
+	// blur by about half a preview pixel, keeping the edges opaque
+	blur := float64(max(width, height)) / placeholderSize / 2
+	alpha := ""
+	if opaque {
+		alpha = `<feComponentTransfer><feFuncA type="discrete" tableValues="1 1"/></feComponentTransfer>`
+	}
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+
+		`<filter id="b" color-interpolation-filters="sRGB"><feGaussianBlur stdDeviation="%.1f"/>%s</filter>`+
+		`<image width="100%%" height="100%%" preserveAspectRatio="none" filter="url(#b)" href="data:image/png;base64,%s"/></svg>`,
+		width, height, width, height, blur, alpha, base64.StdEncoding.EncodeToString(buf.Bytes()))
+	return err
+}
+
+// shrink scales img down to fit size pixels by averaging, and tells
+// whether the result is opaque.
+func shrink(img *image.RGBA, size int) (*image.RGBA, bool) {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	pw, ph := size, size
+	if w > h {
+		ph = max(1, (h*size+w/2)/w)
+	} else {
+		pw = max(1, (w*size+h/2)/h)
+	}
+	pw, ph = min(pw, max(w, 1)), min(ph, max(h, 1))
+
+	sums := make([][4]int, pw*ph)
+	counts := make([]int, pw*ph)
+	for y := 0; y < h; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := 0; x < w; x++ {
+			cell := y*ph/h*pw + x*pw/w
+			for ch := 0; ch < 4; ch++ {
+				sums[cell][ch] += int(row[4*x+ch])
+			}
+			counts[cell]++
+		}
+	}
+	preview := image.NewRGBA(image.Rect(0, 0, pw, ph))
+	opaque := true
+	for i, sum := range sums {
+		if counts[i] == 0 {
+			continue
+		}
+		for ch := 0; ch < 4; ch++ {
+			preview.Pix[4*i+ch] = uint8((sum[ch] + counts[i]/2) / counts[i])
+		}
+		opaque = opaque && preview.Pix[4*i+3] == 255
+	}
+	return preview, opaque
+}
+
+// placeholderScript loads the real image when a placeholder is tapped, by
+// requesting it again with proxy.PlaceholderParam turning placeholders off.
+// The image loads like any other, so cross-origin images need no CORS. The
+// first tap on an image inside a link loads the image instead of following
+// the link.
+const placeholderScript = `<script>(function(){` +
+	`document.addEventListener("click",function(e){` +
+	`var i=e.target;if(i.tagName!=="IMG"||i.dataset.compyLoaded)return;` +
+	`var u=i.currentSrc||i.src;if(!/^https?:/.test(u))return;` +
+	`e.preventDefault();e.stopPropagation();i.dataset.compyLoaded="1";` +
+	`var h=u.indexOf("#"),f=h<0?"":u.slice(h);if(h>=0)u=u.slice(0,h);` +
+	`var p=i.parentNode;if(p&&p.tagName==="PICTURE")p.querySelectorAll("source").forEach(function(s){s.remove()});` +
+	`i.removeAttribute("srcset");i.src=u+(u.indexOf("?")<0?"?":"&")+"` + proxy.PlaceholderParam + `=off"+f` +
+	`},true)})()</script>`
+
+// PlaceholderScript adds the script loading tapped placeholders to HTML
+// documents requested with placeholders. It goes inside Zip, as it
+// appends to the decoded body.
+type PlaceholderScript struct {
+	proxy.Transcoder
+}
+
+func (t *PlaceholderScript) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
+	if !placeholderRequested(headers) || !isDocumentRequest(headers) || r.Header().Get("Content-Encoding") != "" {
+		return t.Transcoder.Transcode(w, r, headers)
+	}
+	if err := t.Transcoder.Transcode(w, r, headers); err != nil {
+		return err
+	}
+	// browsers move content after </html> into the body
+	_, err := io.WriteString(w, placeholderScript)
+	return err
+}
+
+// isDocumentRequest tells whether a request is for a page rather than,
+// say, an HTML fragment fetched by a script.
+func isDocumentRequest(headers http.Header) bool {
+	switch headers.Get("Sec-Fetch-Dest") {
+	case "document", "iframe", "frame":
+		return true
+	case "":
+		return strings.Contains(headers.Get("Accept"), "text/html")
+	}
+	return false
+}
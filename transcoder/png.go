@@ -1,32 +1,71 @@
 package transcoder
 
 import (
+	"bytes"
 	"github.com/barnacs/compy/proxy"
-	"github.com/chai2010/webp"
+	"image"
 	"image/png"
+	"io/ioutil"
 	"net/http"
 )
 
-type Png struct{}
+type Png struct {
+	// LossyQuality enables lossy encoding when positive: WebP capable
+	// clients get lossy WebP (with alpha) of this quality (1-100), others
+	// a palette quantized PNG if it's at least MinPSNR close to the
+	// original.
+	LossyQuality int
+	// MinPSNR is the lowest peak signal-to-noise ratio, in dB, of a
+	// quantized image to the original to send it instead.
+	MinPSNR float64
+	// Avif enables AVIF output for clients accepting it, nil to disable.
+	Avif *Avif
+}
 
 func (t *Png) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
-	img, err := png.Decode(r)
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return err
 	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	// ancillary chunks are dropped, apply those affecting the looks
+	img = readPngMetadata(data).normalize(img)
 
-	if SupportsWebP(headers) {
+	addVary(w.Header(), "Accept")
+	format, release := t.Avif.negotiate(headers, "image/png", true)
+	defer release()
+	switch format {
+	case "image/avif":
+		w.Header().Set("Content-Type", "image/avif")
+		return encodeAvif(w, img, t.Avif.Quality, t.Avif.Speed)
+	case "image/webp":
 		w.Header().Set("Content-Type", "image/webp")
-		options := webp.Options{
-			Lossless: true,
-		}
-		if err = webp.Encode(w, img, &options); err != nil {
+		lossy := t.LossyQuality > 0 && LossyWebP
+		if err = encodeWebP(w, img, !lossy, t.LossyQuality); err != nil {
 			return err
 		}
-	} else {
+	default:
+		if t.LossyQuality > 0 && truecolor(img) {
+			if quantized := quantize(img, 256); psnr(img, quantized) >= t.MinPSNR {
+				img = quantized
+			}
+		}
 		if err = png.Encode(w, img); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// truecolor reports whether img stores full color per pixel, and so
+// benefits from palette quantization.
+func truecolor(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA, *image.NRGBA, *image.RGBA64, *image.NRGBA64:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,201 @@
+package transcoder
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// quantize reduces img to a palette of at most n colors, chosen by median
+// cut over the premultiplied RGBA histogram so that transparency survives.
+// Images with few enough distinct colors are converted exactly, anything
+// else is dithered with Floyd-Steinberg error diffusion.
+func quantize(img image.Image, n int) *image.Paletted {
+	rgba := toRGBA(img)
+	hist := histogram(rgba)
+
+	boxes := []*colorBox{newColorBox(hist)}
+	for len(boxes) < n {
+		i := worstBox(boxes)
+		if i < 0 {
+			break
+		}
+		a, b := boxes[i].split()
+		boxes[i] = a
+		boxes = append(boxes, b)
+	}
+	palette := make(color.Palette, len(boxes))
+	for i, b := range boxes {
+		palette[i] = b.mean()
+	}
+
+	paletted := image.NewPaletted(rgba.Bounds(), palette)
+	if len(hist) <= n {
+		draw.Draw(paletted, paletted.Bounds(), rgba, rgba.Bounds().Min, draw.Src)
+	} else {
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), rgba, rgba.Bounds().Min)
+	}
+	return paletted
+}
+
+// psnr returns the peak signal-to-noise ratio of b relative to a, in dB,
+// over premultiplied RGBA channels. Identical images give +Inf.
+func psnr(a, b image.Image) float64 {
+	bounds := a.Bounds()
+	var sse float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			for _, d := range [4]float64{
+				float64(r1>>8) - float64(r2>>8),
+				float64(g1>>8) - float64(g2>>8),
+				float64(b1>>8) - float64(b2>>8),
+				float64(a1>>8) - float64(a2>>8),
+			} {
+				sse += d * d
+			}
+		}
+	}
+	if sse == 0 {
+		return math.Inf(1)
+	}
+	mse := sse / float64(4*bounds.Dx()*bounds.Dy())
+	return 10 * math.Log10(255*255/mse)
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return rgba
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
+
+type colorCount struct {
+	c     [4]uint8
+	count int
+}
+
+func histogram(img *image.RGBA) []colorCount {
+	counts := make(map[[4]uint8]int)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(bounds.Min.X, y):img.PixOffset(bounds.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			counts[[4]uint8{row[i], row[i+1], row[i+2], row[i+3]}]++
+		}
+	}
+	hist := make([]colorCount, 0, len(counts))
+	for c, count := range counts {
+		hist = append(hist, colorCount{c, count})
+	}
+	return hist
+}
+
+// colorBox is a set of histogram entries, along with the channel of
+// largest spread and the sum of squared errors against the box's mean.
+type colorBox struct {
+	colors  []colorCount
+	channel int
+	sse     float64
+}
+
+func newColorBox(colors []colorCount) *colorBox {
+	b := &colorBox{colors: colors}
+	var sum, sumSq [4]float64
+	var total float64
+	min, max := [4]uint8{255, 255, 255, 255}, [4]uint8{}
+	for _, cc := range colors {
+		n := float64(cc.count)
+		total += n
+		for ch, v := range cc.c {
+			sum[ch] += n * float64(v)
+			sumSq[ch] += n * float64(v) * float64(v)
+			if v < min[ch] {
+				min[ch] = v
+			}
+			if v > max[ch] {
+				max[ch] = v
+			}
+		}
+	}
+	worst := -1.0
+	for ch := range sum {
+		sse := sumSq[ch] - sum[ch]*sum[ch]/total
+		b.sse += sse
+		if sse > worst && max[ch] > min[ch] {
+			worst, b.channel = sse, ch
+		}
+	}
+	return b
+}
+
+// worstBox returns the index of the splittable box with the largest
+// error, or -1 if no box can be split.
+func worstBox(boxes []*colorBox) int {
+	worst := -1
+	for i, b := range boxes {
+		if len(b.colors) > 1 && (worst < 0 || b.sse > boxes[worst].sse) {
+			worst = i
+		}
+	}
+	return worst
+}
+
+// split divides the box at the weighted median of its widest channel.
+func (b *colorBox) split() (*colorBox, *colorBox) {
+	ch := b.channel
+	var counts [256]int
+	total := 0
+	for _, cc := range b.colors {
+		counts[cc.c[ch]] += cc.count
+		total += cc.count
+	}
+	// the box has at least two values in its widest channel, keep the
+	// largest one out of the lower half
+	last := 255
+	for counts[last] == 0 {
+		last--
+	}
+	median, seen := -1, 0
+	for v := 0; v < last; v++ {
+		if counts[v] == 0 {
+			continue
+		}
+		median = v
+		if seen += counts[v]; 2*seen >= total {
+			break
+		}
+	}
+
+	lower := 0
+	for i, cc := range b.colors {
+		if int(cc.c[ch]) <= median {
+			b.colors[i], b.colors[lower] = b.colors[lower], b.colors[i]
+			lower++
+		}
+	}
+	return newColorBox(b.colors[:lower]), newColorBox(b.colors[lower:])
+}
+
+func (b *colorBox) mean() color.Color {
+	var sum [4]float64
+	var total float64
+	for _, cc := range b.colors {
+		n := float64(cc.count)
+		total += n
+		for ch, v := range cc.c {
+			sum[ch] += n * float64(v)
+		}
+	}
+	// averaging premultiplied colors keeps the channels within alpha
+	return color.RGBA{
+		R: uint8(sum[0]/total + 0.5),
+		G: uint8(sum[1]/total + 0.5),
+		B: uint8(sum[2]/total + 0.5),
+		A: uint8(sum[3]/total + 0.5),
+	}
+}
@@ -0,0 +1,532 @@
+package transcoder
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/barnacs/compy/proxy"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLRewriter edits HTML documents as they stream through so pages load
+// less up front. It goes inside Zip, wrapping the transcoder producing the
+// final markup (Identity or Minifier), and leaves bodies it can't decode
+// alone. Tags it doesn't change are passed through byte for byte.
+type HTMLRewriter struct {
+	proxy.Transcoder
+	// LazyLoad adds loading="lazy" to images and iframes, and
+	// decoding="async" to images, unless they say otherwise.
+	LazyLoad bool
+	// MaxSrcsetWidth drops srcset candidates wider than this many pixels,
+	// keeping the narrowest one, 0 to keep all.
+	MaxSrcsetWidth int
+	// DropPreloads removes preloads of images, fonts, audio and video,
+	// which compete with the page itself for the link.
+	DropPreloads bool
+	// Blocker supplies element hiding rules, injected as CSS: the rules
+	// for the page's domain in the head, the generic rules for classes and
+	// ids found in the page at its end.
+	Blocker *proxy.Blocker
+	// Inline replaces small images by data: URIs, if set.
+	Inline *ImageInliner
+	// Integrity collects the scripts and stylesheets referenced with an
+	// integrity attribute, if set, for the transcoders to leave alone.
+	Integrity *IntegrityURLs
+}
+
+// document is the state of a document being rewritten.
+type document struct {
+	base     *url.URL
+	req      *http.Request
+	headers  http.Header
+	hider    *hider
+	deadline time.Time
+}
+
+// heavyPreloads are the preload destinations DropPreloads removes.
+var heavyPreloads = map[string]bool{
+	"image": true,
+	"font":  true,
+	"audio": true,
+	"video": true,
+}
+
+func (t *HTMLRewriter) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
+	contentType := r.ContentType()
+	if r.Header().Get("Content-Encoding") != "" || contentType != "text/html" && contentType != "application/xhtml+xml" {
+		return t.Transcoder.Transcode(w, r, headers)
+	}
+	doc := &document{req: r.Request(), headers: headers}
+	if doc.req != nil {
+		doc.base = doc.req.URL
+		doc.hider = newHider(t.Blocker.ElementHiding(doc.req.URL))
+	}
+	if t.Inline != nil {
+		doc.deadline = time.Now().Add(t.Inline.Timeout)
+		// inlined images are negotiated like the others
+		addVary(w.Header(), "Accept")
+	}
+	pr, pw := io.Pipe()
+	go func(src io.Reader) {
+		pw.CloseWithError(t.rewrite(pw, src, doc))
+	}(r.Reader)
+	// stop the rewriter if the transcoder gives up early
+	defer pr.Close()
+	r.Reader = pr
+	return t.Transcoder.Transcode(w, r, headers)
+}
+
+func (t *HTMLRewriter) rewrite(w io.Writer, r io.Reader, doc *document) error {
+	z := html.NewTokenizer(r)
+	bw := bufio.NewWriter(w)
+	h := doc.hider
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				h.writeSpecific(bw)
+				h.writeGeneric(bw)
+				return bw.Flush()
+			}
+			return z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			// Token unescapes attributes in the buffer Raw points into
+			raw := append([]byte(nil), z.Raw()...)
+			token := z.Token()
+			if token.DataAtom == atom.Body {
+				h.writeSpecific(bw)
+			}
+			h.see(&token)
+			attrs := append([]html.Attribute(nil), token.Attr...)
+			keep, changed := t.rewriteTag(&token, doc)
+			switch {
+			case !keep:
+			case changed:
+				spliceTag(bw, raw, attrs, &token)
+			default:
+				bw.Write(raw)
+			}
+		case html.EndTagToken:
+			raw := z.Raw()
+			if name, _ := z.TagName(); atom.Lookup(name) == atom.Head {
+				h.writeSpecific(bw)
+			}
+			bw.Write(raw)
+		default:
+			bw.Write(z.Raw())
+		}
+	}
+}
+
+// spliceTag writes a start tag changed by rewriteTag, given its raw bytes
+// and its attributes as they were. Only the changed and added attributes
+// are written anew, the rest is copied as it was, as re-encoding the tag
+// would mangle documents in other encodings than UTF-8.
+func spliceTag(w *bufio.Writer, raw []byte, attrs []html.Attribute, token *html.Token) {
+	nameEnd, spans := attrSpans(raw)
+	if len(spans) != len(attrs) || len(token.Attr) < len(attrs) {
+		w.Write(raw)
+		return
+	}
+	pos := 0
+	for i, a := range attrs {
+		if token.Attr[i].Val == a.Val {
+			continue
+		}
+		w.Write(raw[pos:spans[i][0]])
+		writeAttr(w, token.Attr[i])
+		pos = spans[i][1]
+	}
+	end := nameEnd
+	if len(spans) > 0 {
+		end = spans[len(spans)-1][1]
+	}
+	w.Write(raw[pos:end])
+	for _, a := range token.Attr[len(attrs):] {
+		w.WriteByte(' ')
+		writeAttr(w, a)
+	}
+	w.Write(raw[end:])
+}
+
+func writeAttr(w *bufio.Writer, a html.Attribute) {
+	w.WriteString(a.Key)
+	w.WriteString(`="`)
+	w.WriteString(html.EscapeString(a.Val))
+	w.WriteByte('"')
+}
+
+// attrSpans scans a raw start tag the way html.Tokenizer does, returning
+// the end of the tag name and the extent of each attribute the tokenizer
+// reports, from its name to the end of its value and closing quote.
+func attrSpans(raw []byte) (nameEnd int, spans [][2]int) {
+	isSpace := func(c byte) bool {
+		return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f'
+	}
+	skipSpace := func(i int) int {
+		for i < len(raw) && isSpace(raw[i]) {
+			i++
+		}
+		return i
+	}
+	i := 2
+	for i < len(raw) && !isSpace(raw[i]) && raw[i] != '/' && raw[i] != '>' {
+		i++
+	}
+	nameEnd = i
+	for i = skipSpace(i); i < len(raw) && raw[i] != '>'; i = skipSpace(i) {
+		start := i
+		for i < len(raw) {
+			c := raw[i]
+			if c == '=' && i == start {
+				i++
+				continue
+			}
+			if c == '=' || c == '/' || c == '>' || isSpace(c) {
+				break
+			}
+			i++
+		}
+		keyEnd, end := i, i
+		if j := skipSpace(i); j < len(raw) && raw[j] == '/' {
+			i = j + 1
+		} else if j < len(raw) && raw[j] == '=' {
+			i = skipSpace(j + 1)
+			switch {
+			case i >= len(raw) || raw[i] == '>':
+			case raw[i] == '"' || raw[i] == '\'':
+				quote := raw[i]
+				for i++; i < len(raw) && raw[i] != quote; i++ {
+				}
+				if i < len(raw) {
+					i++
+				}
+			default:
+				for i < len(raw) && raw[i] != '>' && !isSpace(raw[i]) {
+					i++
+				}
+			}
+			end = i
+		} else {
+			i = j
+		}
+		if keyEnd > start {
+			spans = append(spans, [2]int{start, end})
+		}
+	}
+	return nameEnd, spans
+}
+
+// hider collects the element hiding rules for a document as it is
+// rewritten.
+type hider struct {
+	rules           *proxy.ElementHiding
+	specificWritten bool
+	seen            map[string]bool
+	generic         []string
+	genericSeen     map[string]bool
+}
+
+func newHider(rules *proxy.ElementHiding) *hider {
+	if rules == nil {
+		return nil
+	}
+	return &hider{
+		rules:       rules,
+		seen:        make(map[string]bool),
+		genericSeen: make(map[string]bool),
+	}
+}
+
+// see collects the generic rules for the classes and id of a tag.
+func (h *hider) see(token *html.Token) {
+	if h == nil {
+		return
+	}
+	keys := strings.Fields(attr(token, "class"))
+	for i := range keys {
+		keys[i] = "." + keys[i]
+	}
+	if id := strings.TrimSpace(attr(token, "id")); id != "" {
+		keys = append(keys, "#"+id)
+	}
+	for _, key := range keys {
+		if h.seen[key] {
+			continue
+		}
+		h.seen[key] = true
+		for _, selector := range h.rules.Generic(key) {
+			if !h.genericSeen[selector] {
+				h.genericSeen[selector] = true
+				h.generic = append(h.generic, selector)
+			}
+		}
+	}
+}
+
+func (h *hider) writeSpecific(w *bufio.Writer) {
+	if h == nil || h.specificWritten {
+		return
+	}
+	h.specificWritten = true
+	writeHidingStyle(w, h.rules.Specific)
+}
+
+func (h *hider) writeGeneric(w *bufio.Writer) {
+	if h == nil {
+		return
+	}
+	writeHidingStyle(w, h.generic)
+}
+
+// writeHidingStyle writes a rule per selector, as a single unsupported
+// selector invalidates the whole selector list of a rule.
+func writeHidingStyle(w *bufio.Writer, selectors []string) {
+	if len(selectors) == 0 {
+		return
+	}
+	w.WriteString("<style>")
+	for _, selector := range selectors {
+		if strings.Contains(selector, "<") {
+			continue
+		}
+		w.WriteString(selector)
+		w.WriteString("{display:none!important}")
+	}
+	w.WriteString("</style>")
+}
+
+// rewriteTag edits a start tag in place. It returns whether to keep the
+// tag at all, and whether it was changed.
+func (t *HTMLRewriter) rewriteTag(token *html.Token, doc *document) (keep, changed bool) {
+	t.integrity(token, doc)
+	switch token.DataAtom {
+	case atom.Base:
+		if doc.base != nil && hasAttr(token, "href") {
+			if base, err := doc.base.Parse(strings.TrimSpace(attr(token, "href"))); err == nil {
+				doc.base = base
+			}
+		}
+	case atom.Img:
+		if t.LazyLoad && !strings.EqualFold(attr(token, "fetchpriority"), "high") {
+			changed = setDefaultAttr(token, "loading", "lazy") || changed
+			changed = setDefaultAttr(token, "decoding", "async") || changed
+		}
+		changed = t.limitSrcset(token, "srcset") || changed
+		changed = t.inline(token, doc) || changed
+	case atom.Iframe:
+		if t.LazyLoad {
+			changed = setDefaultAttr(token, "loading", "lazy")
+		}
+	case atom.Source:
+		changed = t.limitSrcset(token, "srcset")
+	case atom.Link:
+		if t.DropPreloads && hasToken(attr(token, "rel"), "preload") &&
+			heavyPreloads[strings.ToLower(strings.TrimSpace(attr(token, "as")))] {
+			return false, true
+		}
+		changed = t.limitSrcset(token, "imagesrcset")
+	}
+	return true, changed
+}
+
+// integrity remembers the resource a script or link tag with an integrity
+// attribute refers to.
+func (t *HTMLRewriter) integrity(token *html.Token, doc *document) {
+	if t.Integrity == nil || doc.base == nil || !hasAttr(token, "integrity") {
+		return
+	}
+	var ref string
+	switch token.DataAtom {
+	case atom.Script:
+		ref = attr(token, "src")
+	case atom.Link:
+		ref = attr(token, "href")
+	}
+	if ref = strings.TrimSpace(ref); ref == "" {
+		return
+	}
+	if u, err := doc.base.Parse(ref); err == nil {
+		u.Fragment = ""
+		t.Integrity.Add(u.String())
+	}
+}
+
+// inline replaces the source of an image without a srcset by a data: URI.
+func (t *HTMLRewriter) inline(token *html.Token, doc *document) bool {
+	if t.Inline == nil || doc.base == nil || hasAttr(token, "srcset") {
+		return false
+	}
+	src := strings.TrimSpace(attr(token, "src"))
+	if src == "" || strings.HasPrefix(strings.ToLower(src), "data:") {
+		return false
+	}
+	u, err := doc.base.Parse(src)
+	if err != nil {
+		return false
+	}
+	if t.Blocker != nil {
+		check, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return false
+		}
+		check.Header.Set("Sec-Fetch-Dest", "image")
+		check.Header.Set("Referer", doc.req.URL.String())
+		if t.Blocker.Blocks(check) {
+			return false
+		}
+	}
+	uri := t.Inline.inline(u, doc.req, doc.headers, doc.deadline)
+	if uri == "" {
+		return false
+	}
+	for i, a := range token.Attr {
+		if a.Namespace == "" && a.Key == "src" {
+			token.Attr[i].Val = uri
+		}
+	}
+	return true
+}
+
+func attr(token *html.Token, key string) string {
+	for _, a := range token.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasAttr(token *html.Token, key string) bool {
+	for _, a := range token.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// setDefaultAttr adds an attribute unless the tag has it already.
+func setDefaultAttr(token *html.Token, key, val string) bool {
+	if hasAttr(token, key) {
+		return false
+	}
+	token.Attr = append(token.Attr, html.Attribute{Key: key, Val: val})
+	return true
+}
+
+func hasToken(list, token string) bool {
+	for _, f := range strings.Fields(list) {
+		if strings.EqualFold(f, token) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *HTMLRewriter) limitSrcset(token *html.Token, key string) bool {
+	if t.MaxSrcsetWidth <= 0 {
+		return false
+	}
+	for i, a := range token.Attr {
+		if a.Namespace == "" && a.Key == key {
+			limited := limitSrcset(a.Val, t.MaxSrcsetWidth)
+			token.Attr[i].Val = limited
+			return limited != a.Val
+		}
+	}
+	return false
+}
+
+type srcsetCandidate struct {
+	url        string
+	descriptor string
+}
+
+// width returns the width descriptor of a candidate, 0 if it has none.
+func (c *srcsetCandidate) width() int {
+	if !strings.HasSuffix(c.descriptor, "w") {
+		return 0
+	}
+	w, err := strconv.Atoi(c.descriptor[:len(c.descriptor)-1])
+	if err != nil {
+		return 0
+	}
+	return w
+}
+
+// parseSrcset splits a srcset attribute into image candidates, following
+// the HTML spec closely enough for URLs containing commas, e.g. data URIs.
+func parseSrcset(srcset string) []srcsetCandidate {
+	var candidates []srcsetCandidate
+	isSpace := func(c byte) bool {
+		return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+	}
+	for i := 0; ; {
+		for i < len(srcset) && (isSpace(srcset[i]) || srcset[i] == ',') {
+			i++
+		}
+		if i >= len(srcset) {
+			return candidates
+		}
+		start := i
+		for i < len(srcset) && !isSpace(srcset[i]) {
+			i++
+		}
+		url := srcset[start:i]
+		if strings.HasSuffix(url, ",") {
+			candidates = append(candidates, srcsetCandidate{url: strings.TrimRight(url, ",")})
+			continue
+		}
+		start = i
+		for depth := 0; i < len(srcset) && (srcset[i] != ',' || depth > 0); i++ {
+			switch srcset[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+		}
+		candidates = append(candidates, srcsetCandidate{url, strings.TrimSpace(srcset[start:i])})
+	}
+}
+
+// limitSrcset drops the candidates wider than max, unless that would leave
+// no width candidates, in which case the narrowest one stays.
+func limitSrcset(srcset string, max int) string {
+	candidates := parseSrcset(srcset)
+	var kept []string
+	narrowest := -1
+	dropped := false
+	for i, c := range candidates {
+		if w := c.width(); w > max {
+			dropped = true
+			if narrowest < 0 || w < candidates[narrowest].width() {
+				narrowest = i
+			}
+			continue
+		}
+		kept = append(kept, strings.TrimSpace(c.url+" "+c.descriptor))
+	}
+	if !dropped {
+		return srcset
+	}
+	hasWidth := false
+	for _, c := range candidates {
+		if w := c.width(); w > 0 && w <= max {
+			hasWidth = true
+		}
+	}
+	if !hasWidth {
+		c := candidates[narrowest]
+		kept = append(kept, c.url+" "+c.descriptor)
+	}
+	return strings.Join(kept, ", ")
+}
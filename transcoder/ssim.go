@@ -0,0 +1,104 @@
+package transcoder
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"time"
+)
+
+const (
+	// minAdaptiveQuality is the lowest JPEG quality adaptive encoding tries.
+	minAdaptiveQuality = 20
+	// maxAdaptiveEncodes and maxAdaptiveTime bound the work of the search
+	// per image, which then settles for the lowest quality found so far.
+	maxAdaptiveEncodes = 4
+	maxAdaptiveTime    = 500 * time.Millisecond
+)
+
+// encodeJpegSSIM encodes img with the lowest quality, up to the one in
+// options, whose result has at least the target SSIM to img. The quality
+// is found by binary search, taking at most maxAdaptiveEncodes encodes
+// besides the fallback to the configured quality.
+func encodeJpegSSIM(img image.Image, options jpegOptions, target float64) ([]byte, error) {
+	start := time.Now()
+	original := luma(img)
+	maxQuality := options.quality
+	var best []byte
+	for lo, hi, encodes := minAdaptiveQuality, maxQuality, 0; lo <= hi && encodes < maxAdaptiveEncodes && time.Since(start) < maxAdaptiveTime; encodes++ {
+		options.quality = (lo + hi) / 2
+		var buf bytes.Buffer
+		if err := encodeJpeg(&buf, img, options); err != nil {
+			return nil, err
+		}
+		decoded, err := decodeJpeg(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		if ssim(original, luma(decoded)) >= target {
+			best = buf.Bytes()
+			hi = options.quality - 1
+		} else {
+			lo = options.quality + 1
+		}
+	}
+	if best == nil {
+		options.quality = maxQuality
+		var buf bytes.Buffer
+		err := encodeJpeg(&buf, img, options)
+		return buf.Bytes(), err
+	}
+	return best, nil
+}
+
+func luma(img image.Image) *image.Gray {
+	if ycbcr, ok := img.(*image.YCbCr); ok {
+		return &image.Gray{Pix: ycbcr.Y, Stride: ycbcr.YStride, Rect: ycbcr.Rect}
+	}
+	gray := image.NewGray(img.Bounds())
+	draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+	return gray
+}
+
+// ssim returns the mean structural similarity of two equally sized
+// grayscale images over 8x8 windows, 1 meaning identical.
+func ssim(a, b *image.Gray) float64 {
+	const (
+		window = 8
+		c1     = (0.01 * 255) * (0.01 * 255)
+		c2     = (0.03 * 255) * (0.03 * 255)
+	)
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Dx() != bb.Dx() || ab.Dy() != bb.Dy() {
+		return 0
+	}
+	var total float64
+	windows := 0
+	for y := 0; y+window <= ab.Dy(); y += window {
+		for x := 0; x+window <= ab.Dx(); x += window {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for wy := y; wy < y+window; wy++ {
+				for wx := x; wx < x+window; wx++ {
+					va := float64(a.Pix[a.PixOffset(ab.Min.X+wx, ab.Min.Y+wy)])
+					vb := float64(b.Pix[b.PixOffset(bb.Min.X+wx, bb.Min.Y+wy)])
+					sumA += va
+					sumB += vb
+					sumAA += va * va
+					sumBB += vb * vb
+					sumAB += va * vb
+				}
+			}
+			const n = window * window
+			meanA, meanB := sumA/n, sumB/n
+			varA, varB := sumAA/n-meanA*meanA, sumBB/n-meanB*meanB
+			cov := sumAB/n - meanA*meanB
+			total += (2*meanA*meanB + c1) * (2*cov + c2) /
+				((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+	if windows == 0 {
+		return 1
+	}
+	return total / float64(windows)
+}
@@ -0,0 +1,209 @@
+package transcoder
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"image"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/barnacs/compy/proxy"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+// maxRasterPixels bounds the size of rasterized SVG images.
+const maxRasterPixels = 4 << 20
+
+// SVG minifies SVG images and may rasterize large ones. It goes outside
+// Zip, which compresses the SVG sent, as a rasterized image mustn't be
+// content-encoded.
+type SVG struct {
+	proxy.Transcoder
+	// Minifier minifies the images, nil to keep them as they are.
+	Minifier *Minifier
+	// RasterizeSize is the size in bytes above which an image, once
+	// minified, is rendered at its intrinsic size and transcoded by the
+	// image transcoders of Images, if that is smaller. 0 disables
+	// rasterizing. Images using SVG features the renderer lacks, e.g.
+	// text, filters or scripts, are never rasterized, nor are those
+	// without an intrinsic size or displayed larger than it.
+	RasterizeSize int
+	Images        *proxy.Proxy
+}
+
+func (t *SVG) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
+	if r.ContentType() != "image/svg+xml" {
+		return t.Transcoder.Transcode(w, r, headers)
+	}
+	data, ok, err := readDecoded(r)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return t.Transcoder.Transcode(w, r, headers)
+	}
+	w.Header().Del("Content-Encoding")
+
+	if t.Minifier != nil {
+		host := ""
+		if req := r.Request(); req != nil {
+			host = req.URL.Hostname()
+		}
+		data = t.Minifier.minify(host, "image/svg+xml", data)
+	}
+	if t.RasterizeSize > 0 {
+		for _, name := range []string{"Accept", "Sec-CH-DPR", "DPR", "Sec-CH-Width", "Width"} {
+			addVary(w.Header(), name)
+		}
+		if len(data) > t.RasterizeSize {
+			if contentType, raster := t.rasterize(r.Request(), headers, data); raster != nil {
+				w.Header().Set("Content-Type", contentType)
+				_, err := w.Write(raster)
+				return err
+			}
+		}
+	}
+	r.Reader = bytes.NewReader(data)
+	return t.Transcoder.Transcode(w, r, headers)
+}
+
+// rasterize returns the transcoded rendering of an SVG image if it is
+// smaller, nil otherwise.
+func (t *SVG) rasterize(req *http.Request, headers http.Header, data []byte) (string, []byte) {
+	width, height, ok := svgSize(data)
+	if !ok || !fitsDisplay(headers, width) {
+		return "", nil
+	}
+	img, err := renderSVG(data, width, height)
+	if err != nil {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", nil
+	}
+	contentType, raster := transcodeEmbedded(t.Images, req, headers, "image/png", buf.Bytes())
+	if raster == nil {
+		contentType, raster = "image/png", buf.Bytes()
+	}
+	if len(raster) >= len(data) {
+		return "", nil
+	}
+	return contentType, raster
+}
+
+// fitsDisplay tells whether an image width pixels wide is displayed at
+// most that large, as far as the client hints tell. Rendering it larger
+// would change the layout of pages that leave images at their intrinsic
+// size, so denser displays keep the SVG instead.
+func fitsDisplay(headers http.Header, width int) bool {
+	if dpr, err := strconv.ParseFloat(clientHint(headers, "DPR"), 64); err == nil && dpr > 1 {
+		return false
+	}
+	if displayed, err := strconv.ParseFloat(clientHint(headers, "Width"), 64); err == nil && displayed > float64(width) {
+		return false
+	}
+	return true
+}
+
+// clientHint returns the value of a client hint header, sent with or
+// without the Sec-CH- prefix depending on the browser.
+func clientHint(headers http.Header, name string) string {
+	if v := headers.Get("Sec-CH-" + name); v != "" {
+		return v
+	}
+	return headers.Get(name)
+}
+
+// svgUnits are the absolute lengths an SVG image can be sized in, in CSS
+// pixels. Relative ones depend on where it is displayed.
+var svgUnits = map[string]float64{
+	"":   1,
+	"px": 1,
+	"pt": 96.0 / 72,
+	"pc": 16,
+	"in": 96,
+	"cm": 96 / 2.54,
+	"mm": 96 / 25.4,
+}
+
+// svgSize returns the intrinsic size of an SVG image in CSS pixels, from
+// the width and height of its root element, one of them following from
+// the aspect ratio of the viewBox if missing. ok is false if it has none,
+// as when it takes the size the page gives it.
+func svgSize(data []byte) (width, height int, ok bool) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return 0, 0, false
+		}
+		root, isStart := token.(xml.StartElement)
+		if !isStart {
+			continue
+		}
+		var w, h, ratio float64
+		for _, attr := range root.Attr {
+			switch attr.Name.Local {
+			case "width":
+				w = svgLength(attr.Value)
+			case "height":
+				h = svgLength(attr.Value)
+			case "viewBox":
+				if box := strings.Fields(strings.Replace(attr.Value, ",", " ", -1)); len(box) == 4 {
+					bw, errW := strconv.ParseFloat(box[2], 64)
+					bh, errH := strconv.ParseFloat(box[3], 64)
+					if errW == nil && errH == nil && bw > 0 && bh > 0 {
+						ratio = bw / bh
+					}
+				}
+			}
+		}
+		switch {
+		case w > 0 && h <= 0 && ratio > 0:
+			h = w / ratio
+		case h > 0 && w <= 0 && ratio > 0:
+			w = h * ratio
+		}
+		if w <= 0 || h <= 0 || w*h > maxRasterPixels {
+			return 0, 0, false
+		}
+		return int(math.Ceil(w)), int(math.Ceil(h)), true
+	}
+}
+
+// svgLength returns an absolute length in CSS pixels, 0 for others.
+func svgLength(v string) float64 {
+	v = strings.TrimSpace(v)
+	i := len(v)
+	for i > 0 && ('a' <= v[i-1] && v[i-1] <= 'z' || 'A' <= v[i-1] && v[i-1] <= 'Z') {
+		i--
+	}
+	scale, ok := svgUnits[strings.ToLower(v[i:])]
+	n, err := strconv.ParseFloat(v[:i], 64)
+	if !ok || err != nil || n <= 0 {
+		return 0
+	}
+	return n * scale
+}
+
+// renderSVG renders an SVG image scaled to width by height pixels.
+func renderSVG(data []byte, width, height int) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.StrictErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	if width <= 0 || height <= 0 || width*height > maxRasterPixels {
+		return nil, errors.New("unsupported SVG image size")
+	}
+	icon.SetTarget(0, 0, float64(width), float64(height))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	scanner := rasterx.NewScannerGV(width, height, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(width, height, scanner), 1)
+	return img, nil
+}
@@ -1,15 +1,46 @@
 package transcoder
 
 import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
 	"net/http"
-	"strings"
+
+	"github.com/barnacs/compy/proxy"
 )
 
+// SupportsWebP reports whether the client explicitly accepts WebP images.
+// Wildcards don't count, as clients without WebP support send them too.
 func SupportsWebP(headers http.Header) bool {
-	for _, v := range strings.Split(headers.Get("Accept"), ",") {
-		if strings.SplitN(v, ";", 2)[0] == "image/webp" {
-			return true
+	q, explicit := ParseAccept(headers.Get("Accept")).Quality("image/webp")
+	return explicit && q > 0
+}
+
+// readDecoded reads a response body, undoing a gzip or brotli content
+// encoding and removing the Content-Encoding header. It returns false,
+// reading nothing, for other encodings.
+func readDecoded(r *proxy.ResponseReader) ([]byte, bool, error) {
+	var body io.Reader = r.Reader
+	switch r.Header().Get("Content-Encoding") {
+	case "":
+	case "gzip":
+		gzr, err := gzip.NewReader(r.Reader)
+		if err != nil {
+			return nil, false, err
 		}
+		defer gzr.Close()
+		body = gzr
+	case "br":
+		brr := newBrotliReader(r.Reader)
+		defer brr.Close()
+		body = brr
+	default:
+		return nil, false, nil
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, false, err
 	}
-	return false
+	r.Header().Del("Content-Encoding")
+	return data, true, nil
 }
@@ -2,61 +2,138 @@ package transcoder
 
 import (
 	"compress/gzip"
+	"fmt"
+	"io"
 	"net/http"
 	"strings"
 
 	"github.com/barnacs/compy/proxy"
-	brotlidec "gopkg.in/kothar/brotli-go.v0/dec"
-	brotlienc "gopkg.in/kothar/brotli-go.v0/enc"
+	"github.com/klauspost/compress/zstd"
 )
 
 type Zip struct {
 	proxy.Transcoder
 	BrotliCompressionLevel int
-	GzipCompressionLevel   int
-	SkipCompressed         bool
+	// BrotliWindow is the base 2 logarithm of the brotli window size
+	// (10-24), 0 meaning the default of 22.
+	BrotliWindow         int
+	GzipCompressionLevel int
+	SkipCompressed       bool
+	// MinSize is the smallest body worth compressing, in bytes.
+	MinSize int
+	// ZstdCompressionLevel enables zstd when positive (1-22).
+	ZstdCompressionLevel int
+	// ZstdDictionary is an optional zstd dictionary used to decode
+	// upstream responses compressed with it. Responses are never encoded
+	// with it: browsers only decode plain zstd, dictionary compression
+	// being the separate dcz coding negotiated with Available-Dictionary.
+	ZstdDictionary []byte
 }
 
-func (t *Zip) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
-	shouldBrotli := false
-	shouldGzip := false
-	for _, v := range strings.Split(headers.Get("Accept-Encoding"), ", ") {
-		switch strings.SplitN(v, ";", 2)[0] {
-		case "br":
-			shouldBrotli = true
-		case "gzip":
-			shouldGzip = true
+const zstdMaxWindow = 8 << 20
+
+// incompressibleTypes are formats that are already compressed, so they
+// are never content-encoded even if a broad pattern routes them here.
+var incompressibleTypes = []string{
+	"image/jpeg",
+	"image/png",
+	"image/gif",
+	"image/webp",
+	"image/avif",
+	"image/heic",
+	"video/",
+	"audio/",
+	"font/woff",
+	"font/woff2",
+	"application/font-woff",
+	"application/font-woff2",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/zstd",
+	"application/pdf",
+	"application/octet-stream",
+}
+
+func compressible(contentType string) bool {
+	for _, t := range incompressibleTypes {
+		if contentType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(contentType, t) {
+			return false
 		}
 	}
+	return true
+}
 
-	// always gunzip if the client supports Brotli
-	if r.Header().Get("Content-Encoding") == "gzip" && (shouldBrotli || !t.SkipCompressed) {
-		gzr, err := gzip.NewReader(r.Reader)
-		if err != nil {
-			return err
+func (t *Zip) String() string {
+	return fmt.Sprintf("Zip(%T, zstd %d, br %d (%s), gzip %d)", t.Transcoder,
+		t.ZstdCompressionLevel, t.BrotliCompressionLevel, BrotliImplementation, t.GzipCompressionLevel)
+}
+
+func (t *Zip) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, headers http.Header) error {
+	accept := ParseAccept(headers.Get("Accept-Encoding"))
+	encoding := accept.Negotiate(append(t.encodings(), "identity")...)
+	if encoding == "identity" {
+		encoding = ""
+	}
+	addVary(w.Header(), "Accept-Encoding")
+
+	switch r.Header().Get("Content-Encoding") {
+	case "gzip":
+		// always gunzip if the client supports something better
+		if encoding == "br" || encoding == "zstd" || !t.SkipCompressed {
+			gzr, err := gzip.NewReader(r.Reader)
+			if err != nil {
+				return err
+			}
+			defer gzr.Close()
+			t.decoded(w, r, gzr)
+		}
+	case "br":
+		if !t.SkipCompressed {
+			brr := newBrotliReader(r.Reader)
+			defer brr.Close()
+			t.decoded(w, r, brr)
+		}
+	case "zstd":
+		if !t.SkipCompressed {
+			zr, err := zstd.NewReader(r.Reader, zstd.WithDecoderConcurrency(1), zstd.WithDecoderDicts(t.dicts()...))
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+			t.decoded(w, r, zr)
 		}
-		defer gzr.Close()
-		r.Reader = gzr
-		r.Header().Del("Content-Encoding")
-		w.Header().Del("Content-Encoding")
 	}
 
-	if r.Header().Get("Content-Encoding") == "br" && !t.SkipCompressed {
-		brr := brotlidec.NewBrotliReader(r.Reader)
-		defer brr.Close()
-		r.Reader = brr
-		r.Header().Del("Content-Encoding")
-		w.Header().Del("Content-Encoding")
+	// compress regardless of size and type if the client refuses identity
+	identity, _ := accept.Quality("identity")
+	if identity > 0 && (!compressible(r.ContentType()) || t.tooSmall(r)) || !compress(r) {
+		encoding = ""
 	}
 
-	if shouldBrotli && compress(r) {
-		params := brotlienc.NewBrotliParams()
-		params.SetQuality(t.BrotliCompressionLevel)
-		brw := brotlienc.NewBrotliWriter(params, w.Writer)
+	switch encoding {
+	case "zstd":
+		zw, err := zstd.NewWriter(w.Writer,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(t.ZstdCompressionLevel)),
+			zstd.WithEncoderConcurrency(1),
+			// browsers don't accept windows larger than 8MB
+			zstd.WithWindowSize(zstdMaxWindow))
+		if err != nil {
+			return err
+		}
+		defer zw.Close()
+		w.Writer = zw
+		w.Header().Set("Content-Encoding", "zstd")
+	case "br":
+		brw := newBrotliWriter(w.Writer, t.BrotliCompressionLevel, t.BrotliWindow)
 		defer brw.Close()
 		w.Writer = brw
 		w.Header().Set("Content-Encoding", "br")
-	} else if shouldGzip && compress(r) {
+	case "gzip":
 		gzw, err := gzip.NewWriterLevel(w.Writer, t.GzipCompressionLevel)
 		if err != nil {
 			return err
@@ -68,6 +145,36 @@ func (t *Zip) Transcode(w *proxy.ResponseWriter, r *proxy.ResponseReader, header
 	return t.Transcoder.Transcode(w, r, headers)
 }
 
+// encodings lists the supported content codings in order of preference.
+func (t *Zip) encodings() []string {
+	if t.ZstdCompressionLevel > 0 {
+		return []string{"zstd", "br", "gzip"}
+	}
+	return []string{"br", "gzip"}
+}
+
+// decoded replaces the body with its decoded form.
+func (t *Zip) decoded(w *proxy.ResponseWriter, r *proxy.ResponseReader, decoder io.Reader) {
+	r.Reader = decoder
+	r.Header().Del("Content-Encoding")
+	w.Header().Del("Content-Encoding")
+}
+
+func (t *Zip) dicts() [][]byte {
+	if t.ZstdDictionary == nil {
+		return nil
+	}
+	return [][]byte{t.ZstdDictionary}
+}
+
+func (t *Zip) tooSmall(r *proxy.ResponseReader) bool {
+	if t.MinSize <= 0 {
+		return false
+	}
+	b, _ := r.Peek(t.MinSize)
+	return len(b) < t.MinSize
+}
+
 func compress(r *proxy.ResponseReader) bool {
 	return r.Header().Get("Content-Encoding") == ""
 }